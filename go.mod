@@ -4,4 +4,4 @@ go 1.20
 
 require github.com/google/go-cmp v0.5.9
 
-require github.com/x448/float16 v0.8.4 // indirect
+require github.com/x448/float16 v0.8.4
@@ -35,6 +35,7 @@ func main() {
 
 	d.Add(data)
 	t := d.GetDict(512)
+	fmt.Printf("Dictionary of %d strings, expected to save %d bytes\n", len(t), d.ExpectedSavings(t))
 
 	fmt.Println("Generating MuON")
 
@@ -44,17 +45,11 @@ func main() {
 	}
 	defer of.Close()
 
-	m := muon.NewMuWriter(of)
-	m.TagMuon()
-	if len(t) > 128 {
-		tRev := make([]string, len(t))
-		for i, j := 0, len(t)-1; i < len(t); i, j = i+1, j-1 {
-			tRev[i] = t[j]
-		}
-		m.AddLRUList(tRev)
-		panic("wrong path!")
-	} else {
-		m.AddLRUDynamic(t)
+	m := muon.NewMuWriter(of, muon.WithDictionary(t))
+	if err := m.TagMuon(); err != nil {
+		panic(err) // TODO: err handling
+	}
+	if err := m.Add(data); err != nil {
+		panic(err) // TODO: err handling
 	}
-	m.Add(data)
 }
@@ -0,0 +1,241 @@
+package muon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ArrayType is the element type of a typed array. Its value is the tag byte
+// that MuON uses for a single value of that type.
+type ArrayType byte
+
+const (
+	Int8Array    ArrayType = 0xB0
+	Int16Array   ArrayType = 0xB1
+	Int32Array   ArrayType = 0xB2
+	Int64Array   ArrayType = 0xB3
+	Uint8Array   ArrayType = 0xB4
+	Uint16Array  ArrayType = 0xB5
+	Uint32Array  ArrayType = 0xB6
+	Uint64Array  ArrayType = 0xB7
+	Float16Array ArrayType = 0xB8
+	Float32Array ArrayType = 0xB9
+	Float64Array ArrayType = 0xBA
+	// VarIntArray elements are signed LEB128 integers of any size.
+	VarIntArray ArrayType = 0xBB
+)
+
+var arrayTypeNames = map[ArrayType]string{
+	Int8Array:    "int8",
+	Int16Array:   "int16",
+	Int32Array:   "int32",
+	Int64Array:   "int64",
+	Uint8Array:   "uint8",
+	Uint16Array:  "uint16",
+	Uint32Array:  "uint32",
+	Uint64Array:  "uint64",
+	Float16Array: "float16",
+	Float32Array: "float32",
+	Float64Array: "float64",
+	VarIntArray:  "varint",
+}
+
+func (t ArrayType) String() string {
+	if name, ok := arrayTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ArrayType(0x%02X)", byte(t))
+}
+
+// sliceArrayTypes maps the slice types that are written as typed arrays to
+// their element type.
+var sliceArrayTypes = map[reflect.Type]ArrayType{
+	reflect.TypeOf([]int8(nil)):    Int8Array,
+	reflect.TypeOf([]int16(nil)):   Int16Array,
+	reflect.TypeOf([]int32(nil)):   Int32Array,
+	reflect.TypeOf([]int64(nil)):   Int64Array,
+	reflect.TypeOf([]uint8(nil)):   Uint8Array,
+	reflect.TypeOf([]uint16(nil)):  Uint16Array,
+	reflect.TypeOf([]uint32(nil)):  Uint32Array,
+	reflect.TypeOf([]uint64(nil)):  Uint64Array,
+	reflect.TypeOf([]Float16(nil)): Float16Array,
+	reflect.TypeOf([]float32(nil)): Float32Array,
+	reflect.TypeOf([]float64(nil)): Float64Array,
+	reflect.TypeOf([]int(nil)):     VarIntArray,
+}
+
+// appendArrayElems appends the encoding of the elements of the numeric slice
+// s to b, little-endian as the format requires. It reports false if s can't
+// be written as a typed array of type t: int8 arrays take []int8, float64
+// arrays []float64 and so on, and VarIntArray takes []int or []int64.
+func appendArrayElems(b []byte, t ArrayType, s any) ([]byte, int, bool) {
+	le := binary.LittleEndian
+	switch s := s.(type) {
+	case []int8:
+		if t != Int8Array {
+			break
+		}
+		for _, v := range s {
+			b = append(b, byte(v))
+		}
+		return b, len(s), true
+	case []int16:
+		if t != Int16Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint16(b, uint16(v))
+		}
+		return b, len(s), true
+	case []int32:
+		if t != Int32Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint32(b, uint32(v))
+		}
+		return b, len(s), true
+	case []int64:
+		switch t {
+		case Int64Array:
+			for _, v := range s {
+				b = le.AppendUint64(b, uint64(v))
+			}
+			return b, len(s), true
+		case VarIntArray:
+			for _, v := range s {
+				b = append(b, sleb128encode(v)...)
+			}
+			return b, len(s), true
+		}
+	case []int:
+		if t != VarIntArray {
+			break
+		}
+		for _, v := range s {
+			b = append(b, sleb128encode(int64(v))...)
+		}
+		return b, len(s), true
+	case []uint8:
+		if t != Uint8Array {
+			break
+		}
+		return append(b, s...), len(s), true
+	case []uint16:
+		if t != Uint16Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint16(b, v)
+		}
+		return b, len(s), true
+	case []uint32:
+		if t != Uint32Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint32(b, v)
+		}
+		return b, len(s), true
+	case []uint64:
+		if t != Uint64Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint64(b, v)
+		}
+		return b, len(s), true
+	case []Float16:
+		if t != Float16Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint16(b, v.Bits())
+		}
+		return b, len(s), true
+	case []float32:
+		if t != Float32Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint32(b, math.Float32bits(v))
+		}
+		return b, len(s), true
+	case []float64:
+		if t != Float64Array {
+			break
+		}
+		for _, v := range s {
+			b = le.AppendUint64(b, math.Float64bits(v))
+		}
+		return b, len(s), true
+	}
+	return b, 0, false
+}
+
+// startArray starts a typed array. A plain array is followed by exactly one
+// chunk, a chunked one by any number of chunks and then endArrayChunked. The
+// header is held back until the first chunk, so that the array can be
+// aligned once the chunk's length is known.
+func (mw *muWriter) startArray(t ArrayType, chunked bool) {
+	tag := byte(0x84)
+	if chunked {
+		tag = 0x85
+	}
+	mw.arrayHeader = []byte{tag, byte(t)}
+}
+
+// addArrayChunk writes the elements of the numeric slice chunk, prefixed by
+// their count. In a chunked array a count of 0 ends the array, so empty
+// chunks are left out there.
+func (mw *muWriter) addArrayChunk(t ArrayType, chunk any, chunked bool) {
+	if mw.err != nil {
+		return
+	}
+	payload, n, ok := appendArrayElems(nil, t, chunk)
+	if !ok {
+		mw.err = fmt.Errorf("%w: %T chunk in a %v array", ErrUnsupportedType, chunk, t)
+		return
+	}
+	if n == 0 && chunked {
+		return
+	}
+	count := uleb128encode(n)
+	if mw.arrayHeader != nil {
+		mw.align(getTypeWidth(byte(t)), len(mw.arrayHeader)+len(count))
+		mw.write(mw.arrayHeader)
+		mw.arrayHeader = nil
+	}
+	mw.write(count)
+	mw.write(payload)
+}
+
+// align writes padding so that the elements of a typed array, which follow
+// a header of n bytes, start at a multiple of width bytes from the start of
+// the output, if arrays are to be aligned and that position is known.
+func (mw *muWriter) align(width, n int) {
+	if !mw.opts.alignArrays || mw.opts.canonical || len(mw.held) > 0 || width <= 1 {
+		return
+	}
+	// the ID of the shared dictionary goes in front of the padding
+	mw.writeDictID()
+	pad := (width - int((mw.off+int64(n))%int64(width))) % width
+	mw.write(bytes.Repeat([]byte{0xFF}, pad))
+}
+
+// addArray writes the numeric slice s as a typed array with a single chunk.
+func (mw *muWriter) addArray(t ArrayType, s any) {
+	mw.startArray(t, false)
+	mw.addArrayChunk(t, s, false)
+}
+
+func (mw *muWriter) endArrayChunked() {
+	if mw.arrayHeader != nil { // no chunks
+		mw.write(mw.arrayHeader)
+		mw.arrayHeader = nil
+	}
+	mw.append(0x00)
+}
@@ -0,0 +1,118 @@
+package muon
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// Readers with the WithBorrowed option return values that share memory with
+// their input. The helpers below make those values.
+
+// NewBytesDecoder returns a Decoder that reads from data. With the
+// WithBorrowed option, the strings and typed arrays it returns share memory
+// with data, which can be a file mapped by MapFile.
+func NewBytesDecoder(data []byte, opts ...Option) *Decoder {
+	return newMuReader(newDataReader(data), newOptions(opts)).decoder()
+}
+
+// littleEndian reports whether the machine stores numbers in the byte order
+// of MuON's typed arrays.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// borrowString returns b as a string that shares its memory.
+func borrowString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+// borrowArray returns the elements of type t in b as a slice that shares
+// its memory, as decodeArray would return them. It reports false if b isn't
+// aligned for the elements, or the machine's byte order differs.
+func borrowArray(t byte, b []byte) (any, bool) {
+	width := getTypeWidth(t)
+	if len(b) == 0 || width > 1 && !littleEndian || uintptr(unsafe.Pointer(&b[0]))%uintptr(width) != 0 {
+		return nil, false
+	}
+	p, n := unsafe.Pointer(&b[0]), len(b)/width
+	switch t {
+	case 0xB0:
+		return unsafe.Slice((*int8)(p), n), true
+	case 0xB1:
+		return unsafe.Slice((*int16)(p), n), true
+	case 0xB2:
+		return unsafe.Slice((*int32)(p), n), true
+	case 0xB3:
+		return unsafe.Slice((*int64)(p), n), true
+	case 0xB4:
+		return b, true
+	case 0xB5:
+		return unsafe.Slice((*uint16)(p), n), true
+	case 0xB6:
+		return unsafe.Slice((*uint32)(p), n), true
+	case 0xB7:
+		return unsafe.Slice((*uint64)(p), n), true
+	case 0xB8:
+		return unsafe.Slice((*Float16)(p), n), true
+	case 0xB9:
+		return unsafe.Slice((*float32)(p), n), true
+	case 0xBA:
+		return unsafe.Slice((*float64)(p), n), true
+	}
+	return nil, false
+}
+
+// A MappedFile is a file mapped into memory by MapFile.
+type MappedFile struct {
+	data   []byte
+	mapped bool // data is mapped, rather than read into memory
+}
+
+// MapFile maps the file name into memory, read-only, so that it can be read
+// with NewBytesDecoder or Unmarshal without being copied. Where mapping
+// files isn't supported, the file is read into memory instead.
+func MapFile(name string) (*MappedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size > math.MaxInt {
+		return nil, fmt.Errorf("muon: %s is too large to map", name)
+	}
+	if size == 0 {
+		return &MappedFile{}, nil
+	}
+	data, err := mapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data, mapped: mmapSupported}, nil
+}
+
+// Bytes returns the contents of the file. They, and any values borrowed
+// from them, must not be used after Close.
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Close unmaps the file.
+func (m *MappedFile) Close() error {
+	data := m.data
+	m.data = nil
+	if !m.mapped || data == nil {
+		return nil
+	}
+	return unmapFile(data)
+}
@@ -0,0 +1,217 @@
+package muon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// shares reports whether the string or slice v points into data.
+func shares(v any, data []byte) bool {
+	var p uintptr
+	if s, ok := v.(string); ok {
+		p = uintptr(unsafe.Pointer(unsafe.StringData(s)))
+	} else {
+		p = uintptr(reflect.ValueOf(v).UnsafePointer())
+	}
+	start := uintptr(unsafe.Pointer(&data[0]))
+	return p >= start && p < start+uintptr(len(data))
+}
+
+// alignedCopy returns a copy of b that starts at a multiple of 8 bytes in
+// memory, as a mapped file does.
+func alignedCopy(b []byte) []byte {
+	buf := make([]byte, len(b)+8)
+	off := int(-uintptr(unsafe.Pointer(&buf[0])) % 8)
+	return append(buf[off:off], b...)
+}
+
+var borrowDoc = OrderedMap{
+	{Key: "name", Value: "sensor"},
+	{Key: "long", Value: strings.Repeat("z", 600)},
+	{Key: "i8", Value: []int8{-1, 2}},
+	{Key: "u8", Value: []uint8{1, 2, 3}},
+	{Key: "i16", Value: []int16{-3, 4}},
+	{Key: "f16", Value: []Float16{Float16From(0.5)}},
+	{Key: "i32", Value: []int32{-5, 6}},
+	{Key: "u32", Value: []uint32{7, 8}},
+	{Key: "f32", Value: []float32{1.5, -2}},
+	{Key: "i64", Value: []int64{-9, 10}},
+	{Key: "u64", Value: []uint64{11}},
+	{Key: "f64", Value: []float64{0.25, 1e100}},
+}
+
+func TestBorrowed(t *testing.T) {
+	b, err := Marshal(borrowDoc, WithAlignedArrays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := alignedCopy(b)
+
+	var got OrderedMap
+	if err := Unmarshal(data, &got, WithBorrowed()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(borrowDoc, got); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, kv := range got {
+		if !shares(kv.Key, data) {
+			t.Errorf("key %s doesn't share memory with the input", kv.Key)
+		}
+		if !shares(kv.Value, data) {
+			t.Errorf("%s doesn't share memory with the input", kv.Key)
+		}
+	}
+
+	// appending to a borrowed slice doesn't overwrite the input
+	u8, _ := got.Get("u8")
+	_ = append(u8.([]uint8), 0xEE)
+	if !bytes.Equal(b, data) {
+		t.Error("input changed by append")
+	}
+
+	// without the option, values are copied
+	var copied OrderedMap
+	if err := Unmarshal(data, &copied); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range copied {
+		if shares(kv.Value, data) {
+			t.Errorf("%s shares memory without WithBorrowed", kv.Key)
+		}
+	}
+
+	// and so are typed arrays that aren't aligned
+	unaligned := alignedCopy(append([]byte{0xFF}, b...))
+	var shifted OrderedMap
+	if err := Unmarshal(unaligned, &shifted, WithBorrowed()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(borrowDoc, shifted); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, kv := range shifted {
+		typ := reflect.TypeOf(kv.Value)
+		if typ.Kind() == reflect.Slice && typ.Elem().Size() > 1 && shares(kv.Value, unaligned) {
+			t.Errorf("unaligned %s shares memory with the input", kv.Key)
+		}
+	}
+}
+
+func TestBytesDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, WithAlignedArrays())
+	e.Encode("first")
+	e.BeginArray(Float64Array)
+	e.ArrayChunk([]float64{1, 2})
+	e.ArrayChunk([]float64{3})
+	e.EndArray()
+	e.Encode([]uint32{4, 5})
+	if err := e.Encode(nil); err != nil {
+		t.Fatal(err)
+	}
+	data := alignedCopy(buf.Bytes())
+
+	d := NewBytesDecoder(data, WithBorrowed())
+	toks := readTokens(t, d)
+	want := []Token{
+		{Kind: String, Value: "first"},
+		{Kind: TypedArrayChunk, Value: []float64{1, 2}, More: true},
+		{Kind: TypedArrayChunk, Value: []float64{3}},
+		{Kind: TypedArrayChunk, Value: []uint32{4, 5}},
+		{Kind: Null},
+	}
+	if diff := cmp.Diff(want, toks); diff != "" {
+		t.Fatal(diff)
+	}
+	// the first chunk of the chunked array is aligned, the second isn't
+	for i, shared := range []bool{true, true, false, true} {
+		if got := shares(toks[i].Value, data); got != shared {
+			t.Errorf("token %d: got sharing %v, want %v", i, got, shared)
+		}
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	arr := make([]float64, 1000)
+	for i := range arr {
+		arr[i] = float64(i) / 2
+	}
+	b, err := Marshal(map[string]any{"xs": arr}, WithAlignedArrays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "data.mu")
+	if err := os.WriteFile(name, b, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := MapFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, m.Bytes()) {
+		t.Fatal("mapped file differs from what was written")
+	}
+	var got struct{ Xs []float64 }
+	if err := Unmarshal(m.Bytes(), &got, WithBorrowed()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(arr, got.Xs); diff != "" {
+		t.Error(diff)
+	}
+	if !shares(got.Xs, m.Bytes()) {
+		t.Error("array doesn't share memory with the mapped file")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Bytes() != nil {
+		t.Error("Bytes returned data after Close")
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.mu")
+	if err := os.WriteFile(empty, nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := MapFile(empty); err != nil || len(m.Bytes()) != 0 || m.Close() != nil {
+		t.Errorf("empty file: got %v, %v", m, err)
+	}
+	if _, err := MapFile(filepath.Join(t.TempDir(), "missing.mu")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not-exist error", err)
+	}
+}
+
+func BenchmarkBorrowed(b *testing.B) {
+	arr := make([]float64, 1<<16)
+	doc, err := Marshal(arr, WithAlignedArrays())
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := alignedCopy(doc)
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{"copied", nil},
+		{"borrowed", []Option{WithBorrowed()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var got []float64
+				if err := Unmarshal(data, &got, bm.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package muon
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+)
+
+// In canonical mode (WithCanonical) the bytes written for a value depend only
+// on the value: the entries of maps, structs and OrderedMaps are written in
+// key order, and numbers take their shortest exact form. The helpers below
+// put keys in that order.
+
+// Kinds of dict keys, in canonical order.
+const (
+	nullKey = iota
+	boolKey
+	numberKey
+	stringKey
+	otherKey
+)
+
+func keyKind(v reflect.Value) int {
+	if v.IsValid() && (v.Type() == float16Type || v.Type() == bigIntType && !v.IsNil()) {
+		return numberKey
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nullKey
+	case reflect.Bool:
+		return boolKey
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return numberKey
+	case reflect.String:
+		return stringKey
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nullKey
+		}
+	}
+	return otherKey
+}
+
+// keyLess orders dict keys in canonical mode: null first, then false and
+// true, numbers by value with NaN first, strings by their bytes and last
+// everything else, which keeps its order.
+func keyLess(a, b reflect.Value) bool {
+	for a.Kind() == reflect.Interface && !a.IsNil() {
+		a = a.Elem()
+	}
+	for b.Kind() == reflect.Interface && !b.IsNil() {
+		b = b.Elem()
+	}
+	ka, kb := keyKind(a), keyKind(b)
+	if ka != kb {
+		return ka < kb
+	}
+	switch ka {
+	case boolKey:
+		return !a.Bool() && b.Bool()
+	case numberKey:
+		return numberLess(a, b)
+	case stringKey:
+		return a.String() < b.String()
+	}
+	return false
+}
+
+// keyEqual reports whether a and b are the same dict key. Numbers are equal
+// if they have the same value, whatever their types.
+func keyEqual(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if keyKind(va) == numberKey && keyKind(vb) == numberKey {
+		// NaN is never equal, as with ==
+		return !numberLess(va, vb) && !numberLess(vb, va) && !isNaN(va) && !isNaN(vb)
+	}
+	if !va.IsValid() || !vb.IsValid() {
+		return !va.IsValid() && !vb.IsValid()
+	}
+	// == panics on lists and other keys that can't be compared
+	return va.Type().Comparable() && a == b
+}
+
+func isNaN(v reflect.Value) bool {
+	_, f := number(v)
+	return math.IsNaN(f)
+}
+
+// numberLess compares two numbers exactly when both are integers, and as
+// float64 otherwise.
+func numberLess(a, b reflect.Value) bool {
+	ia, fa := number(a)
+	ib, fb := number(b)
+	if ia != nil && ib != nil {
+		return ia.Cmp(ib) < 0
+	}
+	if ia != nil {
+		fa, _ = new(big.Float).SetInt(ia).Float64()
+	}
+	if ib != nil {
+		fb, _ = new(big.Float).SetInt(ib).Float64()
+	}
+	if math.IsNaN(fa) || math.IsNaN(fb) {
+		return math.IsNaN(fa) && !math.IsNaN(fb)
+	}
+	return fa < fb
+}
+
+// number returns the value of the integer v, or nil and the value of the
+// float v.
+func number(v reflect.Value) (*big.Int, float64) {
+	switch v.Type() {
+	case bigIntType:
+		return v.Interface().(*big.Int), 0
+	case float16Type:
+		return nil, float64(v.Interface().(Float16).Float32())
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(v.Int()), 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Int).SetUint64(v.Uint()), 0
+	}
+	return nil, v.Float()
+}
+
+// sortedMapEntries returns the entries of the map v in canonical order. Keys
+// that keyLess doesn't tell apart, such as 1 and 1.0 or two structs, are
+// ordered by their encodings, then by their types and then by the encodings
+// of their values, so that the order doesn't depend on the map's. The
+// entries are read with an iterator, as MapIndex can't find NaN keys.
+func sortedMapEntries(v reflect.Value) []*mapEntry {
+	entries := make([]*mapEntry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		entries = append(entries, &mapEntry{key: iter.Key(), val: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if keyLess(a.key, b.key) {
+			return true
+		}
+		if keyLess(b.key, a.key) {
+			return false
+		}
+		return a.less(b)
+	})
+	return entries
+}
+
+// A mapEntry is an entry of a map being sorted, with its encoding, which is
+// only made for keys that tie.
+type mapEntry struct {
+	key, val reflect.Value
+	keyEnc   []byte
+	valEnc   []byte
+	encoded  bool
+}
+
+// less orders the entries e and o, whose keys tie.
+func (e *mapEntry) less(o *mapEntry) bool {
+	e.encode()
+	o.encode()
+	if c := bytes.Compare(e.keyEnc, o.keyEnc); c != 0 {
+		return c < 0
+	}
+	if te, to := concreteType(e.key), concreteType(o.key); te != to {
+		return te < to
+	}
+	return bytes.Compare(e.valEnc, o.valEnc) < 0
+}
+
+func (e *mapEntry) encode() {
+	if !e.encoded {
+		// values that can't be encoded sort first; writing them fails anyway
+		e.keyEnc, _ = Marshal(e.key.Interface(), WithCanonical())
+		e.valEnc, _ = Marshal(e.val.Interface(), WithCanonical())
+		e.encoded = true
+	}
+}
+
+// concreteType returns the name of the type of the value in v.
+func concreteType(v reflect.Value) string {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	return v.Type().String()
+}
+
+// sortedFields returns a copy of fields sorted by name.
+func sortedFields(fields []field) []field {
+	res := append([]field(nil), fields...)
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+// sortedEntries returns a copy of m with its entries sorted by key. The sort
+// is stable, so entries with the same key keep their order.
+func sortedEntries(m OrderedMap) OrderedMap {
+	res := append(OrderedMap(nil), m...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return keyLess(reflect.ValueOf(res[i].Key), reflect.ValueOf(res[j].Key))
+	})
+	return res
+}
@@ -0,0 +1,237 @@
+package muon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Unmarshaler is implemented by types that read their own MuON encoding.
+// UnmarshalMuON must read exactly one value from d.
+type Unmarshaler interface {
+	UnmarshalMuON(d *Decoder) error
+}
+
+// A Decoder reads MuON values from an input stream.
+type Decoder struct {
+	mr   *muReader
+	open []byte      // tags of the lists and dicts opened by Token
+	arr  *arrayState // typed array in progress, if any
+}
+
+func NewDecoder(r io.Reader, opts ...Option) *Decoder {
+	return NewMuReader(*bufio.NewReader(r), opts...).decoder()
+}
+
+// decoder returns the Decoder that is handed to UnmarshalMuON methods.
+func (mr *muReader) decoder() *Decoder {
+	if mr.dec == nil {
+		mr.dec = &Decoder{mr: mr}
+	}
+	return mr.dec
+}
+
+// Decode reads the next value from the stream and stores it in the value
+// pointed to by v, following the rules of Unmarshal. It returns io.EOF when
+// there are no more values.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	if d.arr != nil {
+		return errors.New("muon: Decode called in the middle of a typed array")
+	}
+	return d.wrapErr(d.mr.decodeValue(rv.Elem()))
+}
+
+// TokenKind identifies the kind of a Token.
+type TokenKind int
+
+const (
+	ListStart TokenKind = iota + 1
+	ListEnd
+	DictStart
+	DictEnd
+	String
+	Int
+	Float
+	Bool
+	Null
+	TypedArrayChunk
+)
+
+var tokenKindNames = [...]string{
+	ListStart:       "ListStart",
+	ListEnd:         "ListEnd",
+	DictStart:       "DictStart",
+	DictEnd:         "DictEnd",
+	String:          "String",
+	Int:             "Int",
+	Float:           "Float",
+	Bool:            "Bool",
+	Null:            "Null",
+	TypedArrayChunk: "TypedArrayChunk",
+}
+
+func (k TokenKind) String() string {
+	if k > 0 && int(k) < len(tokenKindNames) {
+		return tokenKindNames[k]
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+// A Token is one element of a MuON stream, as returned by Decoder.Token.
+//
+// Value holds the string, number or bool for scalar tokens, in the same
+// types ReadObject returns, and the elements of the chunk as a slice such as
+// []uint16 for TypedArrayChunk. It is nil for the other kinds. NaN and the
+// infinities are Float tokens, unless WithNonFiniteAsNull is given.
+type Token struct {
+	Kind  TokenKind
+	Value any
+	// More is set on a TypedArrayChunk when more chunks of the same array
+	// follow.
+	More bool
+}
+
+// arrayState tracks a typed array whose chunks are being returned by Token.
+type arrayState struct {
+	typ     byte
+	chunked bool
+	n       int // length of the next chunk
+}
+
+// Token returns the next token in the stream. Dict keys and values are
+// returned as consecutive tokens. Typed arrays are returned as one
+// TypedArrayChunk per chunk, so arbitrarily long chunked arrays can be read
+// with constant memory. At the end of the stream Token returns io.EOF.
+func (d *Decoder) Token() (Token, error) {
+	mr := d.mr
+	if d.arr != nil {
+		return d.arrayChunk()
+	}
+
+	tag, err := mr.nextTag()
+	if err != nil {
+		return Token{}, d.wrapErr(err)
+	}
+
+	switch {
+	case tag == 0x90 || tag == 0x92:
+		if _, err := mr.inp.ReadByte(); err != nil {
+			return Token{}, err
+		}
+		d.open = append(d.open, tag)
+		if tag == 0x90 {
+			return Token{Kind: ListStart}, nil
+		}
+		return Token{Kind: DictStart}, nil
+	case tag == 0x91 || tag == 0x93:
+		if len(d.open) == 0 || d.open[len(d.open)-1] != tag-1 {
+			return Token{}, mr.syntaxError(tag, nil, "unexpected end of list or dict")
+		}
+		if _, err := mr.inp.ReadByte(); err != nil {
+			return Token{}, err
+		}
+		d.open = d.open[:len(d.open)-1]
+		if tag == 0x91 {
+			return Token{Kind: ListEnd}, nil
+		}
+		return Token{Kind: DictEnd}, nil
+	case tag == 0x84 || tag == 0x85:
+		t, chunked, err := mr.readArrayHeader()
+		if err != nil {
+			return Token{}, d.wrapErr(err)
+		}
+		n, err := mr.readUleb(t)
+		if err != nil {
+			return Token{}, d.wrapErr(err)
+		}
+		d.arr = &arrayState{typ: t, chunked: chunked, n: n}
+		return d.arrayChunk()
+	}
+
+	val, err := mr.readObject()
+	if err != nil {
+		return Token{}, d.wrapErr(err)
+	}
+	switch {
+	case tag <= 0x82 || tag > 0xC1 || tag == 0x8C:
+		return Token{Kind: String, Value: val}, nil
+	case tag == 0xAA || tag == 0xAB:
+		return Token{Kind: Bool, Value: val}, nil
+	case val == nil: // null, or NaN and the infinities with WithNonFiniteAsNull
+		return Token{Kind: Null}, nil
+	case tag >= 0xAD && tag <= 0xAF, tag >= 0xB8 && tag <= 0xBA:
+		return Token{Kind: Float, Value: val}, nil
+	default: // digits, fixed width and LEB128 integers
+		return Token{Kind: Int, Value: val}, nil
+	}
+}
+
+func (d *Decoder) arrayChunk() (Token, error) {
+	mr, a := d.mr, d.arr
+	chunk, err := mr.readArrayChunk(a.typ, a.n)
+	if err != nil {
+		d.arr = nil
+		return Token{}, d.wrapErr(err)
+	}
+	if !a.chunked || a.n == 0 { // a chunked array without elements
+		d.arr = nil
+		return Token{Kind: TypedArrayChunk, Value: chunk}, nil
+	}
+	if a.n, err = mr.readUleb(a.typ); err != nil {
+		d.arr = nil
+		return Token{}, d.wrapErr(err)
+	}
+	if a.n == 0 {
+		d.arr = nil
+	}
+	return Token{Kind: TypedArrayChunk, Value: chunk, More: d.arr != nil}, nil
+}
+
+// wrapErr reports running out of input inside a list or dict opened by Token
+// as a truncated document.
+func (d *Decoder) wrapErr(err error) error {
+	if len(d.open) > 0 {
+		return d.mr.wrapErr(d.open[len(d.open)-1], err)
+	}
+	return err
+}
+
+// More reports whether there is another value in the current list or dict,
+// or another chunk in the current typed array.
+func (d *Decoder) More() bool {
+	if d.arr != nil {
+		return true
+	}
+	tag, err := d.mr.nextTag()
+	return err == nil && tag != 0x91 && tag != 0x93
+}
+
+// Skip reads past the next value, or the rest of the typed array whose
+// chunks are being returned by Token, without decoding it.
+func (d *Decoder) Skip() error {
+	mr := d.mr
+	if a := d.arr; a != nil {
+		d.arr = nil
+		for a.n > 0 || !a.chunked {
+			if err := mr.skipArrayChunk(a.typ, a.n); err != nil {
+				return d.wrapErr(err)
+			}
+			if !a.chunked {
+				return nil
+			}
+			n, err := mr.readUleb(a.typ)
+			if err != nil {
+				return d.wrapErr(err)
+			}
+			a.n = n
+		}
+		return nil
+	}
+	return d.wrapErr(mr.skip())
+}
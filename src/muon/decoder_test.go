@@ -0,0 +1,185 @@
+package muon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func f64bytes(f float64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func readTokens(t *testing.T, d *Decoder) []Token {
+	t.Helper()
+	var toks []Token
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return toks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		toks = append(toks, tok)
+	}
+}
+
+func TestDecoderToken(t *testing.T) {
+	var doc []byte
+	doc = append(doc, MuonMagic...)
+	doc = append(doc, 0x92, 'a', 0x00, 0x90, 0xA1, 'x', 0x00, 0xAC, 0xAB, 0xAD, 0x91)
+	doc = append(doc, 'b', 0x00, 0xBA)
+	doc = append(doc, f64bytes(2.5)...)
+	doc = append(doc, 'c', 0x00, 0x85, 0xB4, 0x02, 0x01, 0x02, 0x01, 0x03, 0x00)
+	doc = append(doc, 'd', 0x00, 0x84, 0xB4, 0x00)
+	doc = append(doc, 'e', 0x00, 0x85, 0xB9, 0x00, 0x93)
+
+	want := []Token{
+		{Kind: DictStart},
+		{Kind: String, Value: "a"},
+		{Kind: ListStart},
+		{Kind: Int, Value: uint8(1)},
+		{Kind: String, Value: "x"},
+		{Kind: Null},
+		{Kind: Bool, Value: true},
+		{Kind: Float, Value: math.NaN()},
+		{Kind: ListEnd},
+		{Kind: String, Value: "b"},
+		{Kind: Float, Value: 2.5},
+		{Kind: String, Value: "c"},
+		{Kind: TypedArrayChunk, Value: []uint8{1, 2}, More: true},
+		{Kind: TypedArrayChunk, Value: []uint8{3}},
+		{Kind: String, Value: "d"},
+		{Kind: TypedArrayChunk, Value: []uint8{}},
+		{Kind: String, Value: "e"},
+		{Kind: TypedArrayChunk, Value: []float32{}},
+		{Kind: DictEnd},
+	}
+
+	got := readTokens(t, NewDecoder(bytes.NewReader(doc)))
+	if diff := cmp.Diff(want, got, cmpopts.EquateNaNs()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	doc := []byte{0x90,
+		0x92, 'k', 0x00, 0x90, 0xA1, 0x91, 'z', 0x00, 0x85, 0xB4, 0x01, 0x07, 0x00, 0x93,
+		0x8C, 's', 0x00,
+		0x84, 0xBA, 0x01}
+	doc = append(doc, f64bytes(1)...)
+	doc = append(doc, 0x81, 0x00, 0x91)
+
+	d := NewDecoder(bytes.NewReader(doc))
+	if tok, err := d.Token(); err != nil || tok.Kind != ListStart {
+		t.Fatalf("got %v, %v, want ListStart", tok, err)
+	}
+	var got []Token
+	for d.More() {
+		// skip everything but strings; the skipped "s" must still reach the LRU
+		if err := d.Skip(); err != nil {
+			t.Fatal(err)
+		}
+		if !d.More() {
+			break
+		}
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tok)
+	}
+	want := []Token{
+		{Kind: String, Value: "s"},
+		{Kind: String, Value: "s"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+	if tok, err := d.Token(); err != nil || tok.Kind != ListEnd {
+		t.Fatalf("got %v, %v, want ListEnd", tok, err)
+	}
+}
+
+func TestDecoderSkipChunks(t *testing.T) {
+	doc := []byte{0x85, 0xB5, 0x01, 0x01, 0x00, 0x02, 0x02, 0x00, 0x03, 0x00, 0x00, 0xA5}
+	d := NewDecoder(bytes.NewReader(doc))
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Token{Kind: TypedArrayChunk, Value: []uint16{1}, More: true}, tok); diff != "" {
+		t.Error(diff)
+	}
+	if err := d.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := d.Token(); err != nil || tok.Value != uint8(5) {
+		t.Errorf("got %v, %v after skipping the array, want 5", tok, err)
+	}
+}
+
+func TestDecoderTokenErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"truncated list", []byte{0x90, 0xA1}, ErrUnexpectedEOF},
+		{"truncated chunked array", []byte{0x85, 0xB4, 0x01, 0x01}, ErrUnexpectedEOF},
+		{"mismatched end", []byte{0x90, 0x93}, nil},
+		{"end without start", []byte{0x91}, nil},
+		{"unknown tag", []byte{0x92, 0x86}, ErrUnknownTag},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(tc.input))
+			var err error
+			for err == nil {
+				_, err = d.Token()
+			}
+			var synErr *SyntaxError
+			if !errors.As(err, &synErr) {
+				t.Fatalf("got error %v, want *SyntaxError", err)
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("got error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecoderTokenAndDecode(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode([]Money{{1, 2}, {3, 0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(&buf)
+	if tok, err := d.Token(); err != nil || tok.Kind != ListStart {
+		t.Fatalf("got %v, %v, want ListStart", tok, err)
+	}
+	var got []Money
+	for d.More() {
+		var m Money
+		if err := d.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if tok, err := d.Token(); err != nil || tok.Kind != ListEnd {
+		t.Fatalf("got %v, %v, want ListEnd", tok, err)
+	}
+	if diff := cmp.Diff([]Money{{1, 2}, {3, 0}}, got); diff != "" {
+		t.Error(diff)
+	}
+}
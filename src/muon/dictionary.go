@@ -0,0 +1,86 @@
+package muon
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// A Dictionary is a list of strings that writer and reader agree on out of
+// band, so that streams can refer to them without carrying them. It suits
+// many small documents with the same keys, where adding the strings to each
+// document costs more than it saves. Both sides get it with
+// WithSharedDictionary; the stream records the ID, and readers with another
+// dictionary, or none, reject it with ErrDictionaryMismatch. The tag that
+// records it is an extension of the MuON spec (see WithSharedDictionary).
+//
+// The strings are in the LRU when a stream starts, Strings[0] being the
+// newest, so the most valuable strings should come first.
+type Dictionary struct {
+	ID      uint32 // derived from Strings by NewDictionary
+	Strings []string
+}
+
+// NewDictionary returns a Dictionary of strs, with an ID that is a hash of
+// them.
+func NewDictionary(strs []string) *Dictionary {
+	return &Dictionary{ID: dictionaryID(strs), Strings: strs}
+}
+
+func dictionaryID(strs []string) uint32 {
+	h := sha256.New()
+	for _, s := range strs {
+		h.Write(uleb128encode(len(s)))
+		h.Write([]byte(s))
+	}
+	return binary.LittleEndian.Uint32(h.Sum(nil))
+}
+
+// Dictionary returns a shared dictionary of up to size of the strings counted
+// so far, the ones expected to save the most bytes first. Unlike the strings
+// returned by GetDict, these are never written to the stream, so any string
+// that takes more bytes than a reference to it is worth including.
+func (d *DictBuilder) Dictionary(size int) *Dictionary {
+	return NewDictionary(d.top(size, func(s string, rank int) int {
+		return d.count[s] * (strCost(s) - refCost(rank))
+	}))
+}
+
+// load adds the strings of d to lru, the first string last.
+func (d *Dictionary) load(lru *LRU) {
+	for i := len(d.Strings) - 1; i >= 0; i-- {
+		lru.Append(d.Strings[i])
+	}
+}
+
+// dictionaryFile is how a Dictionary is stored.
+type dictionaryFile struct {
+	ID      uint32   `muon:"id"`
+	Strings []string `muon:"strings"`
+}
+
+// MarshalBinary returns d as a MuON document, to be stored in a file of its
+// own and read back with UnmarshalBinary.
+func (d *Dictionary) MarshalBinary() ([]byte, error) {
+	var buf []byte
+	buf = append(buf, MuonMagic...)
+	b, err := Marshal(dictionaryFile{d.ID, d.Strings}, WithoutLRU())
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, b...), nil
+}
+
+// UnmarshalBinary reads a Dictionary written by MarshalBinary. It fails if
+// the ID doesn't match the strings, which means the data is damaged.
+func (d *Dictionary) UnmarshalBinary(data []byte) error {
+	var f dictionaryFile
+	if err := Unmarshal(data, &f, WithoutLRU()); err != nil {
+		return err
+	}
+	if id := dictionaryID(f.Strings); id != f.ID {
+		return fmt.Errorf("muon: dictionary ID %08x doesn't match its strings, which hash to %08x", f.ID, id)
+	}
+	d.ID, d.Strings = f.ID, f.Strings
+	return nil
+}
@@ -0,0 +1,132 @@
+package muon
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type message struct {
+	UserID int    `muon:"user_id"`
+	Status string `muon:"status"`
+	Region string `muon:"region"`
+}
+
+func TestSharedDictionary(t *testing.T) {
+	d := NewDictBuilder()
+	for i := 0; i < 100; i++ {
+		status := "active"
+		if i%3 == 0 {
+			status = "suspended"
+		}
+		b, err := Marshal(message{i, status, "eu-west"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sample any
+		if err := Unmarshal(b, &sample); err != nil {
+			t.Fatal(err)
+		}
+		d.Add(sample)
+	}
+	dict := d.Dictionary(16)
+	want := []string{"eu-west", "user_id", "region", "status", "active", "suspended"}
+	if diff := cmp.Diff(want, dict.Strings); diff != "" {
+		t.Error(diff)
+	}
+
+	msg := message{7, "suspended", "eu-west"}
+	plain, err := Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Marshal(msg, WithSharedDictionary(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(plain)/2 {
+		t.Errorf("got %d bytes with the dictionary, want less than half of %d", len(b), len(plain))
+	}
+	if id := append([]byte{0x8D}, uleb128encodeUint(uint64(dict.ID))...); !bytes.HasPrefix(b, id) {
+		t.Errorf("got % x, want it to start with the dictionary ID % x", b, id)
+	}
+	var got message
+	if err := Unmarshal(b, &got, WithSharedDictionary(dict)); err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Errorf("got %+v, want %+v", got, msg)
+	}
+
+	// the magic comes before the dictionary ID
+	var buf bytes.Buffer
+	mw := NewMuWriter(&buf, WithSharedDictionary(dict))
+	mw.TagMuon()
+	mw.Add("eu-west")
+	if want := MuonMagic + string(append(append([]byte{0x8D}, uleb128encodeUint(uint64(dict.ID))...), 0x81, 0x00)); buf.String() != want {
+		t.Errorf("got % x, want % x", buf.Bytes(), want)
+	}
+
+	other := NewDictionary([]string{"region", "status"})
+	for _, opts := range [][]Option{nil, {WithSharedDictionary(other)}} {
+		if err := Unmarshal(b, &got, opts...); !errors.Is(err, ErrDictionaryMismatch) {
+			t.Errorf("got error %v with options %v, want ErrDictionaryMismatch", err, opts)
+		}
+	}
+	if err := Unmarshal(plain, &got, WithSharedDictionary(dict)); !errors.Is(err, ErrDictionaryMismatch) {
+		t.Errorf("got error %v for a stream without a dictionary, want ErrDictionaryMismatch", err)
+	}
+}
+
+func TestDictionaryLargeID(t *testing.T) {
+	dict := &Dictionary{ID: 0xFFFFFFF0, Strings: []string{"status"}}
+	b, err := Marshal(map[string]string{"status": "ok"}, WithSharedDictionary(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := []byte{0x8D, 0xF0, 0xFF, 0xFF, 0xFF, 0x0F}; !bytes.HasPrefix(b, id) {
+		t.Errorf("got % x, want it to start with % x", b, id)
+	}
+	var got map[string]string
+	if err := Unmarshal(b, &got, WithSharedDictionary(dict)); err != nil {
+		t.Fatal(err)
+	}
+	if got["status"] != "ok" {
+		t.Errorf("got %v", got)
+	}
+
+	// IDs past 32 bits match no dictionary, and past 64 bits are malformed
+	for _, id := range [][]byte{
+		{0x8D, 0xF0, 0xFF, 0xFF, 0xFF, 0x1F, 0xA0},
+		{0x8D, 0xF0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, 0xA0},
+	} {
+		var v any
+		err := Unmarshal(id, &v, WithSharedDictionary(dict))
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("% x: got %v, want a SyntaxError", id, err)
+		}
+	}
+}
+
+func TestDictionaryFile(t *testing.T) {
+	dict := NewDictionary([]string{"id", "name", "with\x00nul"})
+	b, err := dict.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Dictionary
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(*dict, got); diff != "" {
+		t.Error(diff)
+	}
+
+	b = bytes.Replace(b, []byte("name"), []byte("nome"), 1)
+	if err := got.UnmarshalBinary(b); err == nil {
+		t.Error("got no error for a damaged dictionary")
+	}
+}
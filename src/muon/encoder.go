@@ -0,0 +1,261 @@
+package muon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Marshaler is implemented by types that write their own MuON encoding.
+// MarshalMuON must write exactly one value to e.
+type Marshaler interface {
+	MarshalMuON(e *Encoder) error
+}
+
+// An Encoder writes MuON values to an output stream.
+//
+// Besides whole values written with Encode, documents can be built one piece
+// at a time with BeginList, BeginDict, Key and the scalar methods, which lets
+// large documents be written without holding them in memory. The Encoder
+// checks that these calls nest properly, and Close checks that everything
+// begun was ended. Like the writer, it stops at the first error and returns
+// it from every later call.
+type Encoder struct {
+	mw   *muWriter
+	open []openValue // lists and dicts begun and not yet ended
+}
+
+// openValue is a list or dict begun on an Encoder, or the single value a
+// MarshalMuON method is expected to write.
+type openValue struct {
+	tag byte      // 0x90 for lists, 0x92 for dicts, 0x85 for arrays and 0 for MarshalMuON
+	n   int       // values written so far; keys count, so a dict wants a key when n is even
+	typ ArrayType // element type of an array
+}
+
+func NewEncoder(w io.Writer, opts ...Option) *Encoder {
+	return NewMuWriter(w, opts...).encoder()
+}
+
+// encoder returns the Encoder that is handed to MarshalMuON methods.
+func (mw *muWriter) encoder() *Encoder {
+	if mw.enc == nil {
+		mw.enc = &Encoder{mw: mw}
+	}
+	return mw.enc
+}
+
+// Encode writes the MuON encoding of v to the stream, following the rules
+// of Marshal.
+func (e *Encoder) Encode(v any) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	return e.mw.Add(v)
+}
+
+// Err returns the first error encountered by the encoder, if any.
+func (e *Encoder) Err() error {
+	return e.mw.err
+}
+
+// Close checks that every list, dict and typed array begun on the encoder
+// has been ended, and returns the first error encountered, if any. Values
+// still open are incomplete, and with size or count tags they haven't been
+// written at all. Close doesn't close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.mw.err != nil {
+		return e.mw.err
+	}
+	if len(e.open) > 0 {
+		switch e.open[len(e.open)-1].tag {
+		case 0x90:
+			return e.fail(errors.New("muon: Close without EndList"))
+		case 0x92:
+			return e.fail(errors.New("muon: Close without EndDict"))
+		case 0x85:
+			return e.fail(errors.New("muon: Close without EndArray"))
+		}
+		return e.fail(errors.New("muon: Close inside MarshalMuON"))
+	}
+	return nil
+}
+
+// BeginList starts a list. The values written up to the matching EndList are
+// its elements.
+func (e *Encoder) BeginList() error {
+	return e.begin(0x90)
+}
+
+// EndList ends the list started by the last unmatched BeginList.
+func (e *Encoder) EndList() error {
+	return e.end(0x90)
+}
+
+// BeginDict starts a dict. Up to the matching EndDict, each Key is followed
+// by exactly one value.
+func (e *Encoder) BeginDict() error {
+	return e.begin(0x92)
+}
+
+// EndDict ends the dict started by the last unmatched BeginDict.
+func (e *Encoder) EndDict() error {
+	return e.end(0x92)
+}
+
+// Key writes a string dict key. It is an error to call Key anywhere but
+// directly inside a dict, where a key is expected. Keys of other types are
+// written with the method for their type, or with Encode.
+func (e *Encoder) Key(k string) error {
+	if e.mw.err != nil {
+		return e.mw.err
+	}
+	if len(e.open) == 0 || e.open[len(e.open)-1].tag != 0x92 || e.open[len(e.open)-1].n%2 != 0 {
+		return e.fail(fmt.Errorf("muon: Key %q where no dict key is expected", k))
+	}
+	return e.String(k)
+}
+
+// String writes a string.
+func (e *Encoder) String(s string) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	e.mw.addStr(s)
+	return e.mw.err
+}
+
+// Int writes an integer.
+func (e *Encoder) Int(i int64) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	e.mw.addInt(i)
+	return e.mw.err
+}
+
+// Float writes a float.
+func (e *Encoder) Float(f float64) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	return e.mw.Add(f)
+}
+
+// Bool writes true or false.
+func (e *Encoder) Bool(b bool) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	return e.mw.Add(b)
+}
+
+// Null writes null.
+func (e *Encoder) Null() error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	return e.mw.Add(nil)
+}
+
+// BeginArray starts a chunked typed array of elements of type t. Its
+// elements are written with any number of calls to ArrayChunk, so the total
+// length doesn't have to be known up front, and the array is ended with
+// EndArray.
+func (e *Encoder) BeginArray(t ArrayType) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	if _, ok := arrayTypeNames[t]; !ok {
+		return e.fail(fmt.Errorf("muon: no typed array for %v", t))
+	}
+	e.mw.startArray(t, true)
+	e.open = append(e.open, openValue{tag: 0x85, typ: t})
+	return e.mw.err
+}
+
+// ArrayChunk writes the elements of chunk to the typed array started by
+// BeginArray. chunk must be a slice of the array's element type, such as
+// []uint16 for Uint16Array, or []int or []int64 for VarIntArray.
+func (e *Encoder) ArrayChunk(chunk any) error {
+	if e.mw.err != nil {
+		return e.mw.err
+	}
+	if len(e.open) == 0 || e.open[len(e.open)-1].tag != 0x85 {
+		return e.fail(errors.New("muon: ArrayChunk without BeginArray"))
+	}
+	e.mw.addArrayChunk(e.open[len(e.open)-1].typ, chunk, true)
+	return e.mw.err
+}
+
+// EndArray ends the typed array started by BeginArray.
+func (e *Encoder) EndArray() error {
+	return e.end(0x85)
+}
+
+func (e *Encoder) begin(tag byte) error {
+	if err := e.value(); err != nil {
+		return err
+	}
+	if tag == 0x90 {
+		e.mw.startList()
+	} else {
+		e.mw.startDict()
+	}
+	e.open = append(e.open, openValue{tag: tag})
+	return e.mw.err
+}
+
+func (e *Encoder) end(tag byte) error {
+	if e.mw.err != nil {
+		return e.mw.err
+	}
+	if len(e.open) == 0 || e.open[len(e.open)-1].tag != tag {
+		switch tag {
+		case 0x90:
+			return e.fail(errors.New("muon: EndList without BeginList"))
+		case 0x92:
+			return e.fail(errors.New("muon: EndDict without BeginDict"))
+		}
+		return e.fail(errors.New("muon: EndArray without BeginArray"))
+	}
+	if tag == 0x92 && e.open[len(e.open)-1].n%2 != 0 {
+		return e.fail(errors.New("muon: EndDict after a key without a value"))
+	}
+	n := e.open[len(e.open)-1].n
+	e.open = e.open[:len(e.open)-1]
+	switch tag {
+	case 0x85:
+		e.mw.endArrayChunked()
+	case 0x90:
+		e.mw.endList(n)
+	default:
+		e.mw.endDict(n / 2)
+	}
+	return e.mw.err
+}
+
+// value checks that a value may be written at the current position and
+// counts it. Any value may be a dict key.
+func (e *Encoder) value() error {
+	if e.mw.err != nil {
+		return e.mw.err
+	}
+	if len(e.open) == 0 {
+		return nil
+	}
+	top := &e.open[len(e.open)-1]
+	switch {
+	case top.tag == 0x85:
+		return e.fail(errors.New("muon: value written inside a typed array"))
+	case top.tag == 0 && top.n > 0:
+		return e.fail(errors.New("muon: MarshalMuON wrote more than one value"))
+	}
+	top.n++
+	return nil
+}
+
+func (e *Encoder) fail(err error) error {
+	e.mw.err = err
+	return err
+}
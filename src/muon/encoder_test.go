@@ -0,0 +1,239 @@
+package muon
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncoderStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.BeginDict()
+	e.Key("rows")
+	e.BeginList()
+	for i := int64(0); i < 3; i++ {
+		e.BeginDict()
+		e.Key("id")
+		e.Int(i)
+		e.Key("name")
+		e.String("row")
+		e.Key("price")
+		e.Encode(Money{1, 50})
+		e.EndDict()
+	}
+	e.EndList()
+	e.Key("ok")
+	e.Bool(true)
+	e.Key("ratio")
+	e.Float(0.5)
+	e.Key("none")
+	e.Null()
+	if err := e.EndDict(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	row := func(id uint8) map[string]any {
+		return map[string]any{"id": id, "name": "row", "price": []any{uint8(1), uint8(50)}}
+	}
+	want := map[string]any{
+		"rows":  []any{row(0), row(1), row(2)},
+		"ok":    true,
+		"ratio": 0.5,
+		"none":  nil,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// twoValues is a broken Marshaler that writes two values.
+type twoValues struct{}
+
+func (twoValues) MarshalMuON(e *Encoder) error {
+	e.Int(1)
+	return e.Int(2)
+}
+
+// openList is a broken Marshaler that doesn't end its list.
+type openList struct{}
+
+func (openList) MarshalMuON(e *Encoder) error {
+	return e.BeginList()
+}
+
+func TestEncoderNesting(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls func(e *Encoder) error
+		want  string
+	}{
+		{"EndDict without BeginDict", func(e *Encoder) error {
+			return e.EndDict()
+		}, "EndDict without BeginDict"},
+		{"EndList closing a dict", func(e *Encoder) error {
+			e.BeginDict()
+			return e.EndList()
+		}, "EndList without BeginList"},
+		{"key in a list", func(e *Encoder) error {
+			e.BeginList()
+			return e.Key("k")
+		}, "no dict key is expected"},
+		{"key in value position", func(e *Encoder) error {
+			e.BeginDict()
+			e.Key("k")
+			return e.Key("k2")
+		}, "no dict key is expected"},
+		{"key without value", func(e *Encoder) error {
+			e.BeginDict()
+			e.Key("k")
+			return e.EndDict()
+		}, "key without a value"},
+		{"sticky", func(e *Encoder) error {
+			e.EndList()
+			return e.Null()
+		}, "EndList without BeginList"},
+		{"marshaler writes two values", func(e *Encoder) error {
+			return e.Encode(twoValues{})
+		}, "more than one value"},
+		{"marshaler leaves a list open", func(e *Encoder) error {
+			return e.Encode(openList{})
+		}, "left open"},
+		{"unended list", func(e *Encoder) error {
+			e.BeginList()
+			e.Int(1)
+			return e.Close()
+		}, "Close without EndList"},
+		{"unended dict", func(e *Encoder) error {
+			e.BeginList()
+			e.EndList()
+			e.BeginDict()
+			return e.Close()
+		}, "Close without EndDict"},
+		{"unended array", func(e *Encoder) error {
+			e.BeginArray(Uint8Array)
+			return e.Close()
+		}, "Close without EndArray"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewEncoder(&bytes.Buffer{})
+			err := tc.calls(e)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got error %v, want %q", err, tc.want)
+			}
+			if e.Err() != err {
+				t.Errorf("got Err() %v, want %v", e.Err(), err)
+			}
+		})
+	}
+}
+
+func TestEncoderInt(t *testing.T) {
+	for _, i := range []int64{math.MaxInt64, math.MinInt64, 1 << 40} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		if err := e.Int(i); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := Marshal(i)
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%d: got % x, want % x", i, buf.Bytes(), want)
+		}
+	}
+}
+
+func TestEncoderChunkedArray(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.BeginList()
+	e.BeginArray(Uint16Array)
+	e.ArrayChunk([]uint16{1, 0x0302})
+	e.ArrayChunk([]uint16{})
+	e.ArrayChunk([]uint16{4})
+	e.EndArray()
+	e.BeginArray(Int8Array)
+	e.EndArray()
+	e.BeginArray(VarIntArray)
+	e.ArrayChunk([]int{-1, 100000})
+	e.ArrayChunk([]int64{5})
+	e.EndArray()
+	if err := e.EndList(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x90,
+		0x85, 0xB5, 0x02, 0x01, 0x00, 0x02, 0x03, 0x01, 0x04, 0x00, 0x00,
+		0x85, 0xB0, 0x00,
+		0x85, 0xBB, 0x02, 0x7F, 0xA0, 0x8D, 0x06, 0x01, 0x05, 0x00,
+		0x91}
+	if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+		t.Error(diff)
+	}
+
+	var got []any
+	if err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	wantValues := []any{[]uint16{1, 0x0302, 4}, []int8{}, []int64{-1, 100000, 5}}
+	if diff := cmp.Diff(wantValues, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestEncoderChunkedArrayErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls func(e *Encoder) error
+		want  string
+	}{
+		{"chunk of the wrong type", func(e *Encoder) error {
+			e.BeginArray(Uint16Array)
+			return e.ArrayChunk([]int16{1})
+		}, "[]int16 chunk in a uint16 array"},
+		{"chunk that isn't a slice", func(e *Encoder) error {
+			e.BeginArray(Float64Array)
+			return e.ArrayChunk(1.5)
+		}, "float64 chunk in a float64 array"},
+		{"chunk without array", func(e *Encoder) error {
+			e.BeginList()
+			return e.ArrayChunk([]uint8{1})
+		}, "ArrayChunk without BeginArray"},
+		{"value in array", func(e *Encoder) error {
+			e.BeginArray(Uint8Array)
+			return e.Int(1)
+		}, "inside a typed array"},
+		{"EndList in array", func(e *Encoder) error {
+			e.BeginList()
+			e.BeginArray(Uint8Array)
+			return e.EndList()
+		}, "EndList without BeginList"},
+		{"EndArray without array", func(e *Encoder) error {
+			return e.EndArray()
+		}, "EndArray without BeginArray"},
+		{"unknown type", func(e *Encoder) error {
+			return e.BeginArray(ArrayType(0x42))
+		}, "no typed array for ArrayType(0x42)"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewEncoder(&bytes.Buffer{})
+			err := tc.calls(e)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package muon
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	// ErrUnexpectedEOF means the input ended in the middle of a value.
+	ErrUnexpectedEOF = errors.New("muon: unexpected EOF")
+	// ErrUnknownTag means a byte that can't start a value was found where a
+	// value was expected.
+	ErrUnknownTag = errors.New("muon: unknown tag")
+	// ErrUnsupportedType is wrapped by errors for values the writer can't
+	// encode. The error message names the Go type.
+	ErrUnsupportedType = errors.New("muon: unsupported type")
+	// ErrDictionaryMismatch means a stream was written with a shared
+	// dictionary other than the one given to the reader, or with none.
+	ErrDictionaryMismatch = errors.New("muon: dictionary mismatch")
+	// ErrNotFound is wrapped by the errors Lookup returns for paths that
+	// lead nowhere in the document.
+	ErrNotFound = errors.New("muon: not found")
+)
+
+// SyntaxError describes malformed MuON input. Err is ErrUnexpectedEOF,
+// ErrUnknownTag or ErrDictionaryMismatch when one of those is the cause, so
+// callers can use errors.Is.
+type SyntaxError struct {
+	Offset int64 // input offset at which the error was detected
+	Tag    byte  // tag byte of the value being read
+	Err    error
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("muon: %s (tag 0x%02X at offset %d)", e.msg, e.Tag, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalTypeError describes a MuON value that can't be stored in a Go
+// value of a given type.
+type UnmarshalTypeError struct {
+	Value  string       // description of the MuON value, e.g. "string" or "number -1"
+	Type   reflect.Type // type of the Go value it could not be assigned to
+	Offset int64        // input offset at which the value starts
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("muon: cannot unmarshal %s into Go value of type %v (offset %d)", e.Value, e.Type, e.Offset)
+}
+
+// UnsupportedValueError describes a value the writer can't encode, such as
+// one that refers to itself.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "muon: unsupported value: " + e.Str
+}
+
+// InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "muon: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Pointer {
+		return "muon: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "muon: Unmarshal(nil " + e.Type.String() + ")"
+}
@@ -0,0 +1,42 @@
+package muon
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/x448/float16"
+)
+
+// Float16 is an IEEE 754 half-precision float, MuON's f16 type. Float16
+// values and slices are written as f16 and f16 typed arrays, and f16 values
+// read into an interface come back as Float16. They can be read into
+// float32 and float64 destinations as well.
+type Float16 float16.Float16
+
+// Float16From returns the Float16 nearest to f.
+func Float16From(f float32) Float16 {
+	return Float16(float16.Fromfloat32(f))
+}
+
+// Float16FromBits returns the Float16 with the IEEE 754 binary16 encoding b.
+func Float16FromBits(b uint16) Float16 {
+	return Float16(float16.Frombits(b))
+}
+
+// Bits returns the IEEE 754 binary16 encoding of f.
+func (f Float16) Bits() uint16 {
+	return uint16(f)
+}
+
+// Float32 returns f as a float32, which holds every Float16 exactly.
+func (f Float16) Float32() float32 {
+	return float16.Float16(f).Float32()
+}
+
+func (f Float16) String() string {
+	return strconv.FormatFloat(float64(f.Float32()), 'g', -1, 32)
+}
+
+func (f Float16) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Float32())
+}
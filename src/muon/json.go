@@ -0,0 +1,174 @@
+package muon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// NonFinitePolicy says what ToJSON does with NaN and the infinities, which
+// JSON has no numbers for.
+type NonFinitePolicy int
+
+const (
+	// NonFiniteNull writes them as null.
+	NonFiniteNull NonFinitePolicy = iota
+	// NonFiniteString writes them as the strings "NaN", "-Infinity" and
+	// "Infinity".
+	NonFiniteString
+	// NonFiniteError makes ToJSON fail.
+	NonFiniteError
+)
+
+// ToJSON returns the JSON encoding of v, a value read by ReadObject or
+// Decode into an interface. It differs from json.Marshal in how it writes
+// MuON values that JSON lacks: NaN and the infinities follow policy, uint8
+// typed arrays are written as arrays of numbers rather than base64, and dict
+// keys that aren't strings are written as the strings of their values.
+func ToJSON(v any, policy NonFinitePolicy) ([]byte, error) {
+	v, err := jsonValue(v, policy)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue returns v with the values that json.Marshal would get wrong
+// replaced.
+func jsonValue(v any, policy NonFinitePolicy) (any, error) {
+	switch val := v.(type) {
+	case float64:
+		return nonFinite(val, v, policy)
+	case float32:
+		return nonFinite(float64(val), v, policy)
+	case Float16:
+		return nonFinite(float64(val.Float32()), v, policy)
+	case []any:
+		res := make([]any, len(val))
+		for i, e := range val {
+			var err error
+			if res[i], err = jsonValue(e, policy); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[any]any:
+		res := make(map[string]any, len(val))
+		for k, e := range val {
+			jk, err := jsonKey(k)
+			if err != nil {
+				return nil, err
+			}
+			je, err := jsonValue(e, policy)
+			if err != nil {
+				return nil, err
+			}
+			res[jk] = je
+		}
+		return res, nil
+	case map[string]any:
+		res := make(map[string]any, len(val))
+		for k, e := range val {
+			je, err := jsonValue(e, policy)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = je
+		}
+		return res, nil
+	case OrderedMap:
+		res := make(OrderedMap, len(val))
+		for i, kv := range val {
+			je, err := jsonValue(kv.Value, policy)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = KeyValue{Key: kv.Key, Value: je}
+		}
+		return res, nil
+	case []uint8:
+		res := make([]uint16, len(val))
+		for i, e := range val {
+			res[i] = uint16(e)
+		}
+		return res, nil
+	case []float32:
+		return floatArray(len(val), func(i int) float64 { return float64(val[i]) }, v, policy)
+	case []float64:
+		return floatArray(len(val), func(i int) float64 { return val[i] }, v, policy)
+	case []Float16:
+		return floatArray(len(val), func(i int) float64 { return float64(val[i].Float32()) }, v, policy)
+	}
+	return v, nil
+}
+
+// jsonKey returns the JSON object key for the dict key k. JSON keys are
+// strings, so numbers, bools and null are written as they would be as
+// values, which can make distinct keys such as 1 and "1" collide.
+func jsonKey(k any) (string, error) {
+	switch k := k.(type) {
+	case string:
+		return k, nil
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(k), nil
+	case *big.Int:
+		return k.String(), nil
+	case float64:
+		return strconv.FormatFloat(k, 'g', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(k), 'g', -1, 32), nil
+	case Float16:
+		return k.String(), nil
+	}
+	switch v := reflect.ValueOf(k); v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("muon: dict key of type %T has no JSON representation", k)
+}
+
+// nonFinite returns v, the float f, unless f is NaN or infinite, in which
+// case it returns what policy replaces it with.
+func nonFinite(f float64, v any, policy NonFinitePolicy) (any, error) {
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return v, nil
+	}
+	switch policy {
+	case NonFiniteNull:
+		return nil, nil
+	case NonFiniteString:
+		switch {
+		case math.IsNaN(f):
+			return "NaN", nil
+		case f < 0:
+			return "-Infinity", nil
+		}
+		return "Infinity", nil
+	}
+	return nil, fmt.Errorf("muon: %v has no JSON representation", f)
+}
+
+// floatArray returns the float array v as is if all of its n elements are
+// finite, and otherwise as a list with the non-finite elements replaced.
+func floatArray(n int, elem func(int) float64, v any, policy NonFinitePolicy) (any, error) {
+	for i := 0; i < n; i++ {
+		if f := elem(i); math.IsNaN(f) || math.IsInf(f, 0) {
+			res := make([]any, n)
+			for i := range res {
+				var err error
+				if res[i], err = nonFinite(elem(i), elem(i), policy); err != nil {
+					return nil, err
+				}
+			}
+			return res, nil
+		}
+	}
+	return v, nil
+}
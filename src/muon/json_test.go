@@ -0,0 +1,85 @@
+package muon
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestNonFinite(t *testing.T) {
+	in := []any{math.NaN(), math.Inf(-1), math.Inf(1), float32(math.Inf(1))}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []any{math.NaN(), math.Inf(-1), math.Inf(1), math.Inf(1)}
+	if diff := cmp.Diff(want, got, cmpopts.EquateNaNs()); diff != "" {
+		t.Error(diff)
+	}
+
+	var floats [4]float32
+	if err := Unmarshal(b, &floats); err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(float64(floats[0])) || !math.IsInf(float64(floats[1]), -1) || !math.IsInf(float64(floats[3]), 1) {
+		t.Errorf("got %v, want [NaN -Inf +Inf +Inf]", floats)
+	}
+
+	if err := Unmarshal(b, &got, WithNonFiniteAsNull()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]any{nil, nil, nil, nil}, got); diff != "" {
+		t.Error(diff)
+	}
+
+	d := NewDecoder(bytes.NewReader(b), WithNonFiniteAsNull())
+	d.Token()
+	if tok, err := d.Token(); err != nil || tok.Kind != Null {
+		t.Errorf("got %v, %v, want a Null token with WithNonFiniteAsNull", tok, err)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	v := map[string]any{
+		"list":   []any{math.NaN(), 1.5, math.Inf(-1), "x"},
+		"f32":    []float32{float32(math.Inf(1)), 2},
+		"f64":    []float64{0.5},
+		"bytes":  []uint8{1, 2},
+		"f16":    Float16From(float32(math.NaN())),
+		"nested": map[string]any{"inf": math.Inf(1)},
+		"keys":   map[any]any{uint8(1): "a", nil: math.NaN(), true: "b"},
+	}
+
+	tests := []struct {
+		policy NonFinitePolicy
+		want   string
+	}{
+		{NonFiniteNull, `{"bytes":[1,2],"f16":null,"f32":[null,2],"f64":[0.5],"keys":{"1":"a","null":null,"true":"b"},"list":[null,1.5,null,"x"],"nested":{"inf":null}}`},
+		{NonFiniteString, `{"bytes":[1,2],"f16":"NaN","f32":["Infinity",2],"f64":[0.5],"keys":{"1":"a","null":"NaN","true":"b"},"list":["NaN",1.5,"-Infinity","x"],"nested":{"inf":"Infinity"}}`},
+	}
+	for _, tc := range tests {
+		got, err := ToJSON(v, tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("policy %d: got %s, want %s", tc.policy, got, tc.want)
+		}
+	}
+
+	if _, err := ToJSON(v, NonFiniteError); err == nil || !strings.Contains(err.Error(), "no JSON representation") {
+		t.Errorf("got error %v, want one for the non-finite values", err)
+	}
+	if got, err := ToJSON([]any{1.5, "ok"}, NonFiniteError); err != nil || string(got) != `[1.5,"ok"]` {
+		t.Errorf("got %s, %v for finite values", got, err)
+	}
+}
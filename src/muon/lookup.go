@@ -0,0 +1,170 @@
+package muon
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Lookup reads the value at path in the MuON document r. Each element of
+// path is a list index or a dict key, so Lookup(r, "users", 42, "email") is
+// the email of the 43rd user. Ints index lists and typed arrays, and are
+// dict keys in dicts; other elements are dict keys only. Keys match as for
+// OrderedMap.Get, so the path element 1 finds the key 1.0.
+//
+// The values on the way to the result are skipped without being decoded.
+// If the document has no value at path, Lookup returns an error wrapping
+// ErrNotFound.
+func Lookup(r io.ReaderAt, path ...any) (any, error) {
+	return LookupWith(r, nil, path...)
+}
+
+// LookupWith is Lookup with options: those the document was written with
+// that readers need, such as WithSharedDictionary or WithLRUSize, and those
+// of readers, such as WithNativeInts. With WithSizeTags, values with size
+// tags are jumped over without being read at all, so looking up a value in
+// a document written with size tags reads little more than the keys along
+// the path.
+func LookupWith(r io.ReaderAt, opts []Option, path ...any) (any, error) {
+	mr := newMuReader(newReaderAtReader(r), newOptions(opts))
+	for i, p := range path {
+		tag, err := mr.nextTag()
+		if err == io.EOF {
+			return nil, mr.wrapErr(0, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		idx, isIdx := pathIndex(p)
+		found := false
+		switch {
+		case tag == 0x90 && isIdx:
+			found, err = mr.findIndex(idx)
+		case tag == 0x92:
+			found, err = mr.findKey(p)
+		case (tag == 0x84 || tag == 0x85) && isIdx && i == len(path)-1:
+			var val any
+			val, found, err = mr.arrayElem(idx)
+			if err == nil && found {
+				return val, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %v", ErrNotFound, path[:i+1])
+		}
+	}
+	res, err := mr.readObject()
+	if err == io.EOF {
+		return nil, mr.wrapErr(0, err)
+	}
+	return res, err
+}
+
+// pathIndex returns the path element p as a list index. It reports false if
+// p isn't an int, or is negative.
+func pathIndex(p any) (int, bool) {
+	v := reflect.ValueOf(p)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() >= 0 && v.Int() <= math.MaxInt {
+			return int(v.Int()), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() <= math.MaxInt {
+			return int(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// findIndex reads the list at the current offset up to its element idx. It
+// reports false if the list has no such element.
+func (mr *muReader) findIndex(idx int) (bool, error) {
+	b, err := mr.readByte(0)
+	if err != nil {
+		return false, err
+	}
+	for ; ; idx-- {
+		tag, err := mr.nextTag()
+		if err != nil {
+			return false, mr.wrapErr(b, err)
+		}
+		if tag == 0x91 {
+			return false, nil
+		}
+		if idx == 0 {
+			return true, nil
+		}
+		if err := mr.skip(); err != nil {
+			return false, mr.wrapErr(b, err)
+		}
+	}
+}
+
+// findKey reads the dict at the current offset up to the value of key. It
+// reports false if the dict has no such key.
+func (mr *muReader) findKey(key any) (bool, error) {
+	b, err := mr.readByte(0)
+	if err != nil {
+		return false, err
+	}
+	for {
+		tag, err := mr.nextTag()
+		if err != nil {
+			return false, mr.wrapErr(b, err)
+		}
+		if tag == 0x93 {
+			return false, nil
+		}
+		k, err := mr.readObject()
+		if err != nil {
+			return false, mr.wrapErr(b, err)
+		}
+		if keyEqual(k, key) {
+			return true, nil
+		}
+		if err := mr.skip(); err != nil {
+			return false, mr.wrapErr(b, err)
+		}
+	}
+}
+
+// arrayElem reads element idx of the typed array at the current offset,
+// skipping the elements before it. It reports false if the array has no
+// such element.
+func (mr *muReader) arrayElem(idx int) (any, bool, error) {
+	t, chunked, err := mr.readArrayHeader()
+	if err != nil {
+		return nil, false, err
+	}
+	for {
+		n, err := mr.readUleb(t)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 && chunked {
+			return nil, false, nil
+		}
+		if idx < n {
+			if err := mr.skipArrayChunk(t, idx); err != nil {
+				return nil, false, err
+			}
+			chunk, err := mr.readArrayChunk(t, 1)
+			if err != nil {
+				return nil, false, err
+			}
+			return reflect.ValueOf(chunk).Index(0).Interface(), true, nil
+		}
+		if !chunked {
+			return nil, false, nil
+		}
+		if err := mr.skipArrayChunk(t, n); err != nil {
+			return nil, false, err
+		}
+		idx -= n
+	}
+}
@@ -0,0 +1,185 @@
+package muon
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type user struct {
+	Name  string   `muon:"name"`
+	Email string   `muon:"email"`
+	Bio   string   `muon:"bio"`
+	Tags  []string `muon:"tags"`
+}
+
+// countingReaderAt counts the bytes read from it.
+type countingReaderAt struct {
+	r *bytes.Reader
+	n int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+func lookupDoc() map[string]any {
+	users := make([]user, 100)
+	for i := range users {
+		users[i] = user{
+			Name:  strings.Repeat("n", i),
+			Email: strings.Repeat("e", i) + "@example.com",
+			Bio:   strings.Repeat("b", 10000),
+			Tags:  []string{"a", "b"},
+		}
+	}
+	return map[string]any{
+		"users":   users,
+		"scores":  []uint16{3, 1, 4, 1, 5},
+		"weights": []float64{0.5, 1.5},
+		"nested":  map[any]any{1: []any{true, nil}, "x": "y"},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		path []any
+		want any
+	}{
+		{[]any{"users", 42, "email"}, strings.Repeat("e", 42) + "@example.com"},
+		{[]any{"users", 99, "tags", 1}, "b"},
+		{[]any{"users", uint8(0), "name"}, ""},
+		{[]any{"scores", 4}, uint16(5)},
+		{[]any{"weights", 1}, 1.5},
+		{[]any{"nested", 1.0, 0}, true},
+		{[]any{"nested", int8(1), 1}, nil},
+		{[]any{"nested", "x"}, "y"},
+		{[]any{"users", 1, "tags"}, []any{"a", "b"}},
+	}
+	for _, opts := range [][]Option{nil, {WithSizeTags()}, {WithSizeTags(), WithCountTags()}, {WithAlignedArrays()}} {
+		b, err := Marshal(lookupDoc(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got, err := Lookup(bytes.NewReader(b), tt.path...)
+			if err != nil {
+				t.Errorf("%v: %v", tt.path, err)
+				continue
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("%v: %s", tt.path, diff)
+			}
+		}
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	b, err := Marshal(lookupDoc(), WithSizeTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][]any{
+		{"nobody"},
+		{"users", 100},
+		{"users", -1},
+		{"users", "0"},
+		{"users", 0, "email", 0},
+		{"scores", 5},
+		{"scores", 0, 0},
+		{"nested", 2},
+	} {
+		_, err := Lookup(bytes.NewReader(b), path...)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: got %v, want ErrNotFound", path, err)
+		}
+	}
+
+	for _, path := range [][]any{nil, {"users", 1000}} {
+		_, err := Lookup(bytes.NewReader(b[:len(b)/2]), path...)
+		if !errors.Is(err, ErrUnexpectedEOF) {
+			t.Errorf("truncated %v: got %v, want ErrUnexpectedEOF", path, err)
+		}
+	}
+	if _, err := Lookup(bytes.NewReader(nil)); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("empty: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestLookupOptions(t *testing.T) {
+	dict := NewDictionary([]string{"email", "name", "users"})
+	b, err := Marshal(lookupDoc(), WithSharedDictionary(dict), WithSizeTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := []any{"users", 3, "email"}
+	got, err := LookupWith(bytes.NewReader(b), []Option{WithSharedDictionary(dict)}, path...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "eee@example.com" {
+		t.Errorf("got %q, want eee@example.com", got)
+	}
+	if _, err := Lookup(bytes.NewReader(b), path...); !errors.Is(err, ErrDictionaryMismatch) {
+		t.Errorf("got %v without the dictionary, want ErrDictionaryMismatch", err)
+	}
+
+	b, err = Marshal(lookupDoc(), WithLRUSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = LookupWith(bytes.NewReader(b), []Option{WithLRUSize(8)}, "users", 2, "tags", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "b" {
+		t.Errorf("got %q, want b", got)
+	}
+}
+
+// TestLookupSeeks checks that Lookup jumps over values with size tags
+// instead of reading them.
+func TestLookupSeeks(t *testing.T) {
+	b, err := Marshal(lookupDoc(), WithSizeTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReaderAt{r: bytes.NewReader(b)}
+	got, err := LookupWith(r, []Option{WithSizeTags()}, "users", 90, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("e", 90) + "@example.com"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.n > len(b)/2 {
+		t.Errorf("read %d of %d bytes", r.n, len(b))
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"size tags", []Option{WithSizeTags()}},
+	} {
+		doc, err := Marshal(lookupDoc(), bm.opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := LookupWith(bytes.NewReader(doc), bm.opts, "users", 99, "email"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,24 +2,57 @@ package muon
 
 import (
 	"fmt"
-
-	"github.com/google/go-cmp/cmp"
+	"reflect"
 )
 
+// LRU is the table of recently added strings that MuON streams refer back
+// to with 0x81 tags. It holds up to cap values; appending to a full LRU drops
+// the oldest one. Lookups don't move values, so the order is that in which
+// they were added.
+//
+// Values are kept in a ring buffer, with a map from each value to the
+// sequence number of its newest copy, so appending, lookups by value and
+// lookups by index all take constant time.
 type LRU struct {
 	cap   int
-	deque []any
+	ring  []any
+	first int         // sequence number of the oldest value
+	n     int         // number of values
+	index map[any]int // value to the sequence number of its newest copy
 }
 
 func NewLRU(capacity int) *LRU {
-	return &LRU{capacity, make([]any, 0, capacity)}
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &LRU{cap: capacity, ring: make([]any, capacity), index: make(map[any]int)}
+}
+
+// slot returns the position in the ring of the value with sequence number
+// seq.
+func (lru *LRU) slot(seq int) int {
+	return seq % lru.cap
 }
 
 func (lru *LRU) Append(val any) {
-	if len(lru.deque)+1 > lru.cap {
-		lru.truncate((1))
+	if lru.cap <= 0 {
+		return
+	}
+	if lru.n == lru.cap {
+		old := lru.ring[lru.slot(lru.first)]
+		if hashable(old) && lru.index[old] == lru.first {
+			delete(lru.index, old)
+		}
+		lru.ring[lru.slot(lru.first)] = nil
+		lru.first++
+		lru.n--
+	}
+	seq := lru.first + lru.n
+	lru.ring[lru.slot(seq)] = val
+	lru.n++
+	if hashable(val) {
+		lru.index[val] = seq
 	}
-	lru.deque = append(lru.deque, val)
 }
 
 func (lru *LRU) Extend(list []any) {
@@ -28,50 +61,73 @@ func (lru *LRU) Extend(list []any) {
 	}
 }
 
-// truncate removes n values from the beginning of the LRU
-func (lru *LRU) truncate(n int) {
-	if n > len(lru.deque) {
-		lru.deque = lru.deque[:0]
-		return
-	}
-	lru.deque = lru.deque[n:]
-}
-
+// Get returns a value by its index. Indexes of 0 and below count back from
+// the newest value, as the references in a stream do, so Get(0) is the
+// newest value and Get(-1) the one before it. Positive indexes count from
+// the oldest value.
 func (lru *LRU) Get(idx int) any {
 	if idx <= 0 {
-		lastIdx := len(lru.deque) - 1
-		return lru.deque[lastIdx+idx]
+		idx += lru.n - 1
+	}
+	if idx < 0 || idx >= lru.n {
+		panic(fmt.Errorf("LRU index %d out of range with length %d", idx, lru.n))
 	}
-	return lru.deque[idx]
+	return lru.ring[lru.slot(lru.first+idx)]
 }
 
+// FindIndex returns the index of the newest copy of val, counting from the
+// oldest value, or -1 if val is not in the LRU.
 func (lru *LRU) FindIndex(val any) int {
-	for i, v := range lru.deque {
-		if cmp.Equal(v, val) {
-			return i
-		}
+	if !hashable(val) {
+		return -1
 	}
-	return -1
+	seq, ok := lru.index[val]
+	if !ok {
+		return -1
+	}
+	return seq - lru.first
 }
 
 func (lru *LRU) Contains(val any) bool {
-	for _, v := range lru.deque {
-		if cmp.Equal(v, val) {
-			return true
-		}
-	}
-	return false
+	return lru.FindIndex(val) >= 0
 }
 
+// Remove removes the newest copy of val, moving the values after it back
+// by one. It takes time proportional to the number of values moved.
 func (lru *LRU) Remove(val any) {
 	idx := lru.FindIndex(val)
-	if idx >= 0 {
-		if idx < len(lru.deque)-1 {
-			lru.deque = append(lru.deque[:idx], lru.deque[idx+1:])
-		} else {
-			lru.deque = lru.deque[:idx]
-		}
-	} else {
+	if idx < 0 {
 		panic(fmt.Errorf("val %v not in LRU", val))
 	}
+	delete(lru.index, val)
+	for seq := lru.first + idx; seq < lru.first+lru.n-1; seq++ {
+		next := lru.ring[lru.slot(seq+1)]
+		lru.ring[lru.slot(seq)] = next
+		if hashable(next) && lru.index[next] == seq+1 {
+			lru.index[next] = seq
+		}
+	}
+	lru.n--
+	lru.ring[lru.slot(lru.first+lru.n)] = nil
+	// An older copy of val, if there is one, becomes findable again.
+	for seq := lru.first + idx - 1; seq >= lru.first; seq-- {
+		if v := lru.ring[lru.slot(seq)]; hashable(v) && v == val {
+			lru.index[val] = seq
+			break
+		}
+	}
+}
+
+func (lru *LRU) Len() int {
+	return lru.n
+}
+
+// hashable reports whether v can be a map key that is found again. Streams
+// only put strings in the LRU, but a malformed one can add lists, and NaN,
+// which isn't equal to itself, would never be found or deleted.
+func hashable(v any) bool {
+	if _, ok := v.(string); ok {
+		return true
+	}
+	return v == nil || reflect.ValueOf(v).Comparable() && v == v
 }
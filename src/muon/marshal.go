@@ -0,0 +1,506 @@
+package muon
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Marshal returns the MuON encoding of v.
+//
+// Structs are encoded as dicts. Field names can be changed with a
+// `muon:"name,omitempty"` tag, which follows the same rules as the json tag
+// in encoding/json: "-" skips the field, omitempty skips empty values and the
+// fields of embedded structs are promoted into the outer dict.
+//
+// Maps are encoded as dicts too, and their keys may be strings, numbers,
+// bools or interfaces, so a map[int]string keeps its integer keys. Keys of
+// other types must implement encoding.TextMarshaler, and are written as
+// text; maps with struct, array or pointer keys that don't are an error
+// wrapping ErrUnsupportedType, since Unmarshal couldn't read them back.
+func Marshal(v any, opts ...Option) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := NewMuWriter(&buf, opts...)
+	if err := mw.Add(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addValue writes values that Add has no fast path for.
+func (mw *muWriter) addValue(v reflect.Value) {
+	if mw.err != nil {
+		return
+	}
+	if !v.IsValid() {
+		mw.write([]byte{0xAC})
+		return
+	}
+
+	// Like encoding/json, methods with pointer receivers are only used when
+	// the value is addressable.
+	t := v.Type()
+	if t == bigIntType || t == bigIntType.Elem() {
+		// big.Int is a TextMarshaler, but MuON has integers of any size.
+		switch {
+		case t == bigIntType.Elem() && v.CanAddr():
+			v = v.Addr()
+		case t == bigIntType.Elem():
+			val := v.Interface().(big.Int)
+			v = reflect.ValueOf(&val)
+		case v.IsNil():
+			mw.write([]byte{0xAC})
+			return
+		}
+		mw.addBigInt(v.Interface().(*big.Int))
+		return
+	}
+	if t.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(t).Implements(marshalerType) {
+		v = v.Addr()
+		t = v.Type()
+	}
+	if t.Implements(marshalerType) {
+		if t.Kind() == reflect.Pointer && v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		mw.addMarshaler(v.Interface().(Marshaler))
+		return
+	}
+	if t.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(t).Implements(textMarshalerType) {
+		v = v.Addr()
+		t = v.Type()
+	}
+	if t.Implements(textMarshalerType) {
+		if t.Kind() == reflect.Pointer && v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			mw.err = fmt.Errorf("muon: error calling MarshalText for type %v: %w", t, err)
+			return
+		}
+		mw.addStr(string(text))
+		return
+	}
+
+	if t == float16Type {
+		mw.Add(Float16(v.Uint()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		mw.addValue(v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		if mw.enter(v) {
+			mw.addValue(v.Elem())
+			mw.leave(v)
+		}
+	case reflect.Bool:
+		mw.Add(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		mw.addInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		mw.addUint(v.Uint())
+	case reflect.Float32:
+		mw.Add(float32(v.Float()))
+	case reflect.Float64:
+		mw.Add(v.Float())
+	case reflect.String:
+		mw.addStr(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			mw.Add(v.Bytes())
+			return
+		}
+		// Named slice types of numbers are typed arrays too, but slices of
+		// named number types may have methods of their own and are lists.
+		if t, ok := sliceArrayTypes[reflect.SliceOf(v.Type().Elem())]; ok {
+			mw.addArray(t, v.Convert(reflect.SliceOf(v.Type().Elem())).Interface())
+			return
+		}
+		if mw.enter(v) {
+			mw.addList(v)
+			mw.leave(v)
+		}
+	case reflect.Array:
+		mw.addList(v)
+	case reflect.Map:
+		if kt := v.Type().Key(); !mapKeyKinds[kt.Kind()] && !kt.Implements(textMarshalerType) {
+			// Unmarshal couldn't store the keys
+			mw.err = fmt.Errorf("%w: %v with keys of type %v", ErrUnsupportedType, v.Type(), kt)
+			return
+		}
+		if v.IsNil() {
+			mw.write([]byte{0xAC})
+			return
+		}
+		if !mw.enter(v) {
+			return
+		}
+		mw.startDict()
+		if mw.opts.canonical {
+			for _, e := range sortedMapEntries(v) {
+				mw.addKey(e.key)
+				mw.addValue(e.val)
+			}
+		} else {
+			iter := v.MapRange()
+			for iter.Next() {
+				mw.addKey(iter.Key())
+				mw.addValue(iter.Value())
+			}
+		}
+		mw.endDict(v.Len())
+		mw.leave(v)
+	case reflect.Struct:
+		mw.addStruct(v)
+	default:
+		mw.err = fmt.Errorf("%w: %v", ErrUnsupportedType, v.Type())
+	}
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	float16Type       = reflect.TypeOf(Float16(0))
+	bigIntType        = reflect.TypeOf((*big.Int)(nil))
+)
+
+// startDetectingCyclesAfter is the depth of pointers, maps and slices from
+// which the writer checks for values that refer to themselves. As in
+// encoding/json, checking only deep down keeps it from costing anything for
+// ordinary values.
+const startDetectingCyclesAfter = 1000
+
+// A cycleKey identifies a pointer, map or slice. Slices need their length
+// too, as a slice may contain a shorter slice of itself without a cycle.
+type cycleKey struct {
+	ptr unsafe.Pointer
+	len int
+}
+
+// enter records that v, a pointer, map or slice, is being written. It
+// reports false, having set mw.err to an *UnsupportedValueError, if v is
+// already being written further out, which means it refers to itself.
+func (mw *muWriter) enter(v reflect.Value) bool {
+	mw.depth++
+	if mw.depth <= startDetectingCyclesAfter {
+		return true
+	}
+	k := newCycleKey(v)
+	if mw.seen == nil {
+		mw.seen = make(map[cycleKey]bool)
+	}
+	if mw.seen[k] {
+		mw.depth--
+		if mw.err == nil {
+			mw.err = &UnsupportedValueError{v, fmt.Sprintf("encountered a cycle via %s", v.Type())}
+		}
+		return false
+	}
+	mw.seen[k] = true
+	return true
+}
+
+// leave undoes enter, once v has been written.
+func (mw *muWriter) leave(v reflect.Value) {
+	if mw.depth > startDetectingCyclesAfter {
+		delete(mw.seen, newCycleKey(v))
+	}
+	mw.depth--
+}
+
+func newCycleKey(v reflect.Value) cycleKey {
+	k := cycleKey{ptr: v.UnsafePointer()}
+	if v.Kind() == reflect.Slice {
+		k.len = v.Len()
+	}
+	return k
+}
+
+func (mw *muWriter) addMarshaler(m Marshaler) {
+	// MarshalMuON gets a frame of its own on the Encoder, so that what it
+	// writes is checked to be a single, complete value.
+	e := mw.encoder()
+	depth := len(e.open)
+	e.open = append(e.open, openValue{})
+	err := m.MarshalMuON(e)
+	if err == nil && mw.err == nil {
+		switch {
+		case len(e.open) > depth+1:
+			err = errors.New("list or dict left open")
+		case e.open[depth].n == 0:
+			err = errors.New("no value written")
+		}
+	}
+	e.open = e.open[:depth]
+	if err != nil && mw.err == nil {
+		mw.err = fmt.Errorf("muon: error calling MarshalMuON for type %T: %w", m, err)
+	}
+}
+
+func (mw *muWriter) addList(v reflect.Value) {
+	mw.startList()
+	for i := 0; i < v.Len(); i++ {
+		mw.addValue(v.Index(i))
+	}
+	mw.endList(v.Len())
+}
+
+// addKey writes a map key. Keys of string kind are written as strings even
+// when their type has a MarshalText method; other keys are written like any
+// other value.
+func (mw *muWriter) addKey(k reflect.Value) {
+	if k.Kind() == reflect.String {
+		mw.addStr(k.String())
+		return
+	}
+	mw.addValue(k)
+}
+
+func (mw *muWriter) addStruct(v reflect.Value) {
+	fields := cachedFields(v.Type())
+	if mw.opts.canonical {
+		fields = sortedFields(fields)
+	}
+	mw.startDict()
+	n := 0
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		mw.addStr(f.name)
+		mw.addValue(fv)
+		n++
+	}
+	mw.endDict(n)
+}
+
+// fieldByIndex is like v.FieldByIndex but reports false instead of panicking
+// when the path goes through a nil embedded pointer. With alloc set, nil
+// embedded pointers are allocated instead where possible.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Struct fields
+
+type field struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	tagged    bool
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields returns the fields that are encoded for struct type t, resolving
+// embedded structs the way encoding/json does: a shallower field hides deeper
+// ones with the same name, a tagged field beats an untagged one at the same
+// depth and any remaining conflicts drop all of the conflicting fields.
+func typeFields(t reflect.Type) []field {
+	current := []field{}
+	next := []field{{typ: t}}
+
+	visited := map[reflect.Type]bool{}
+	var fields []field
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count := map[reflect.Type]int{}
+		for _, f := range current {
+			count[f.typ]++
+		}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						ft = ft.Elem()
+					}
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag := sf.Tag.Get("muon")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, field{
+						name:      name,
+						index:     index,
+						typ:       ft,
+						tagged:    tagged,
+						omitEmpty: hasOption(opts, "omitempty"),
+					})
+					if count[f.typ] > 1 {
+						// Two copies of the same embedded struct at this depth
+						// annihilate each other; one entry is enough to make
+						// the name conflict below.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				next = append(next, field{name: ft.Name(), index: index, typ: ft})
+			}
+		}
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool {
+		x := fields
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		fi := fields[i]
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fi.name {
+				break
+			}
+		}
+		if advance == 1 {
+			out = append(out, fi)
+			continue
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+
+	fields = out
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+	return fields
+}
+
+// dominantField picks the field that wins among fields with the same name,
+// which are sorted by depth and then by whether they're tagged.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+	return fields[0], true
+}
+
+func indexLess(a, b []int) bool {
+	for k, x := range a {
+		if k >= len(b) {
+			return false
+		}
+		if x != b[k] {
+			return x < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func hasOption(opts, name string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,963 @@
+package muon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type Address struct {
+	Street string `muon:"street"`
+	City   string `muon:"city,omitempty"`
+}
+
+type Meta struct {
+	Created int
+	Note    string `muon:"note,omitempty"`
+}
+
+type Person struct {
+	Name     string            `muon:"name"`
+	Age      int               `muon:"age"`
+	Email    string            `muon:"email,omitempty"`
+	Password string            `muon:"-"`
+	Dash     string            `muon:"-,"`
+	Alive    bool              `muon:"alive"`
+	Score    float64           `muon:"score"`
+	Tags     []string          `muon:"tags"`
+	Home     *Address          `muon:"home"`
+	Work     *Address          `muon:"work,omitempty"`
+	Labels   map[string]string `muon:"labels"`
+	Pair     [2]int8           `muon:"pair"`
+	Data     []byte            `muon:"data"`
+	Any      any               `muon:"any"`
+	Meta
+	private int
+}
+
+func TestMarshalStruct(t *testing.T) {
+	p := Person{
+		Name:     "Ada",
+		Age:      36,
+		Password: "secret",
+		Dash:     "dash",
+		Alive:    true,
+		Score:    99.5,
+		Tags:     []string{"math", "engines"},
+		Home:     &Address{Street: "St James's Square"},
+		Labels:   map[string]string{"role": "programmer"},
+		Pair:     [2]int8{-1, 100},
+		Data:     []byte{1, 2, 3},
+		Any:      []any{"x", true},
+		Meta:     Meta{Created: 120},
+		private:  1,
+	}
+
+	b, err := Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic map[string]any
+	if err := Unmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	wantKeys := []string{"name", "age", "alive", "score", "tags", "home", "labels", "pair", "data", "any", "-", "Created"}
+	for _, k := range wantKeys {
+		if _, ok := generic[k]; !ok {
+			t.Errorf("missing key %q in %v", k, generic)
+		}
+	}
+	for _, k := range []string{"email", "Password", "work", "note", "Meta", "private"} {
+		if _, ok := generic[k]; ok {
+			t.Errorf("unexpected key %q in %v", k, generic)
+		}
+	}
+	if home := generic["home"].(map[string]any); len(home) != 1 {
+		t.Errorf("got home %v, want only the street", home)
+	}
+
+	var got Person
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := p
+	want.Password = ""
+	want.private = 0
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(Person{})); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestMarshalEmbeddedConflicts(t *testing.T) {
+	type A struct{ X, Y int }
+	type B struct {
+		X int
+		Y int `muon:"Y"`
+	}
+	type C struct {
+		A
+		B
+		Z int
+	}
+	type D struct {
+		*A
+		X string
+	}
+
+	b, err := Marshal(C{A{1, 2}, B{3, 4}, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	// X is ambiguous and dropped, the tagged Y wins.
+	want := map[string]any{"Y": uint8(4), "Z": uint8(5)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+
+	b, err = Marshal(D{nil, "outer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d D
+	if err := Unmarshal([]byte("\x92X\x00outer\x00Y\x00\xA7\x93"), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.X != "outer" || d.A == nil || d.A.Y != 7 {
+		t.Errorf("got %+v, want X promoted from D and Y from the allocated *A", d)
+	}
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	var s struct {
+		I8  int8
+		U16 uint16
+		I   int
+		F32 float32
+		Big int64
+		Neg int
+	}
+	b, err := Marshal(map[string]any{
+		"I8":  -5,
+		"U16": 100,
+		"I":   7,
+		"F32": 1.5,
+		"Big": 100000,
+		"Neg": -100000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.I8 != -5 || s.U16 != 100 || s.I != 7 || s.F32 != 1.5 || s.Big != 100000 || s.Neg != -100000 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var u8 uint8
+	var str string
+	var list []int
+	var m map[string]int
+
+	tests := []struct {
+		name string
+		data any
+		dst  any
+		want string // Value of the UnmarshalTypeError
+	}{
+		{"overflow", 100000, &u8, "number 100000"},
+		{"negative unsigned", -1, &u8, "number -1"},
+		{"string into int", "x", &u8, "string"},
+		{"number into string", 3, &str, "number 3"},
+		{"dict into slice", map[string]any{}, &list, "dict"},
+		{"list into map", []any{}, &m, "list"},
+		{"float into int", 1.5, &u8, "number 1.5"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Marshal(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Unmarshal(b, tc.dst)
+			var typeErr *UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				t.Fatalf("got error %v, want *UnmarshalTypeError", err)
+			}
+			if typeErr.Value != tc.want {
+				t.Errorf("got value %q, want %q", typeErr.Value, tc.want)
+			}
+			if typeErr.Type != reflect.TypeOf(tc.dst).Elem() {
+				t.Errorf("got type %v, want %v", typeErr.Type, reflect.TypeOf(tc.dst).Elem())
+			}
+		})
+	}
+
+	var invalid *InvalidUnmarshalError
+	if err := Unmarshal([]byte{0xA1}, u8); !errors.As(err, &invalid) {
+		t.Errorf("got error %v for non-pointer, want *InvalidUnmarshalError", err)
+	}
+	if err := Unmarshal(nil, &u8); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("got error %v for empty input, want %v", err, ErrUnexpectedEOF)
+	}
+}
+
+func TestUnmarshalNull(t *testing.T) {
+	s := struct {
+		P *int
+		L []int
+		M map[string]int
+		N int
+	}{new(int), []int{1}, map[string]int{"a": 1}, 5}
+
+	if err := Unmarshal([]byte("\x92P\x00\xACL\x00\xACM\x00\xACN\x00\xAC\x93"), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.P != nil || s.L != nil || s.M != nil || s.N != 5 {
+		t.Errorf("got %+v, want nil pointer, slice and map and an untouched int", s)
+	}
+}
+
+// Money is written as a list of whole units and cents.
+type Money struct {
+	Units int
+	Cents int
+}
+
+func (m Money) MarshalMuON(e *Encoder) error {
+	return e.Encode([]any{m.Units, m.Cents})
+}
+
+func (m *Money) UnmarshalMuON(d *Decoder) error {
+	var parts []int
+	if err := d.Decode(&parts); err != nil {
+		return err
+	}
+	if len(parts) != 2 {
+		return fmt.Errorf("money needs 2 parts, got %d", len(parts))
+	}
+	m.Units, m.Cents = parts[0], parts[1]
+	return nil
+}
+
+// Color is written as its name.
+type Color int
+
+const (
+	Red Color = iota
+	Green
+)
+
+var colorNames = []string{"red", "green"}
+
+func (c Color) MarshalText() ([]byte, error) {
+	if int(c) >= len(colorNames) {
+		return nil, fmt.Errorf("bad color %d", int(c))
+	}
+	return []byte(colorNames[c]), nil
+}
+
+func (c *Color) UnmarshalText(text []byte) error {
+	for i, name := range colorNames {
+		if name == string(text) {
+			*c = Color(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown color %q", text)
+}
+
+// Cell is a struct that is written as text, so it can be a map key.
+type Cell struct{ Row, Col int }
+
+func (c Cell) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d:%d", c.Row, c.Col)), nil
+}
+
+func (c *Cell) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%d:%d", &c.Row, &c.Col)
+	return err
+}
+
+func TestMarshalerInterfaces(t *testing.T) {
+	type order struct {
+		Price   Money
+		Refund  *Money
+		Color   Color
+		Colors  map[string]Color
+		ByColor map[Color]int
+		Cells   map[Cell]string
+	}
+	in := order{
+		Price:   Money{12, 34},
+		Refund:  &Money{0, 99},
+		Color:   Green,
+		Colors:  map[string]Color{"bg": Red},
+		ByColor: map[Color]int{Red: 10, Green: 20},
+		Cells:   map[Cell]string{{1, 2}: "a", {3, 4}: "b"},
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic map[string]any
+	if err := Unmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	wantGeneric := map[string]any{
+		"Price":   []any{uint8(12), uint8(34)},
+		"Refund":  []any{uint8(0), uint8(99)},
+		"Color":   "green",
+		"Colors":  map[string]any{"bg": "red"},
+		"ByColor": map[string]any{"red": uint8(10), "green": uint8(20)},
+		"Cells":   map[string]any{"1:2": "a", "3:4": "b"},
+	}
+	if diff := cmp.Diff(wantGeneric, generic); diff != "" {
+		t.Error(diff)
+	}
+
+	var out order
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(in, out); diff != "" {
+		t.Error(diff)
+	}
+
+	// keys UnmarshalText rejects are its errors
+	b, _ = Marshal(map[string]int{"blue": 1})
+	var byColor map[Color]int
+	if err := Unmarshal(b, &byColor); err == nil || !strings.Contains(err.Error(), "unknown color") {
+		t.Errorf("got error %v, want the UnmarshalText error", err)
+	}
+}
+
+func TestUnsupportedMapKeys(t *testing.T) {
+	type pair struct{ A, B int }
+	n := 1
+	for _, v := range []any{
+		map[pair]int{{1, 2}: 3},
+		map[[2]int]int{{1, 2}: 3},
+		map[*int]int{&n: 3},
+		map[string]map[pair]int{"x": nil},
+	} {
+		if _, err := Marshal(v); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%T: got %v, want ErrUnsupportedType", v, err)
+		}
+	}
+
+	// the same keys are fine in an interface, which Unmarshal fills with
+	// the dicts and lists it reads
+	b, err := Marshal(map[any]int{pair{1, 2}: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got OrderedMap
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshalerErrors(t *testing.T) {
+	if _, err := Marshal(Color(7)); err == nil || !strings.Contains(err.Error(), "bad color 7") {
+		t.Errorf("got error %v, want the MarshalText error", err)
+	}
+
+	var m Money
+	b, _ := Marshal([]any{1, 2, 3})
+	if err := Unmarshal(b, &m); err == nil || !strings.Contains(err.Error(), "2 parts") {
+		t.Errorf("got error %v, want the UnmarshalMuON error", err)
+	}
+
+	var c Color
+	b, _ = Marshal(5)
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal(b, &c); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for a number into a TextUnmarshaler, want *UnmarshalTypeError", err)
+	}
+
+	// UnmarshalMuON running out of input is a truncated document, not a clean EOF.
+	dec := NewDecoder(bytes.NewReader([]byte{0x90, 0xA1}))
+	if err := dec.Decode(&m); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want %v", err, ErrUnexpectedEOF)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, m := range []Money{{1, 2}, {3, 4}} {
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	var got []Money
+	for {
+		var m Money
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if diff := cmp.Diff([]Money{{1, 2}, {3, 4}}, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+type Samples []int16
+
+func TestTypedArrays(t *testing.T) {
+	values := []any{
+		[]int8{-128, 0, 127},
+		[]int16{-32768, 1, 32767},
+		[]int32{math.MinInt32, 2, math.MaxInt32},
+		[]int64{math.MinInt64, 3, math.MaxInt64},
+		[]uint8{0, 255},
+		[]uint16{0, 65535},
+		[]uint32{0, math.MaxUint32},
+		[]uint64{0, math.MaxUint64},
+		[]float32{-1.5, float32(math.Inf(1))},
+		[]float64{math.Pi, -0.25},
+		[]int16{},
+	}
+	for _, v := range values {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != 0x84 {
+			t.Errorf("%T encoded as %X, want a typed array", v, b)
+		}
+		var got any
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(v, got); diff != "" {
+			t.Errorf("%T: %s", v, diff)
+		}
+	}
+
+	b, err := Marshal(map[string]any{"s": Samples{1, -2}, "ints": []int{1, -100000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		S    Samples
+		Ints []int
+		Arr  [3]int32
+	}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Samples{1, -2}, s.S); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]int{1, -100000}, s.Ints); diff != "" {
+		t.Error(diff)
+	}
+
+	b, _ = Marshal(map[string]any{"Arr": []int64{7, 8}})
+	s.Arr = [3]int32{1, 2, 3}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Arr != [3]int32{7, 8, 0} {
+		t.Errorf("got %v, want [7 8 0]", s.Arr)
+	}
+
+	var small []int8
+	b, _ = Marshal([]int16{1, 300})
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal(b, &small); !errors.As(err, &typeErr) || typeErr.Value != "number 300" {
+		t.Errorf("got error %v, want number 300 to overflow int8", err)
+	}
+}
+
+func TestAlignedArrays(t *testing.T) {
+	tests := []struct {
+		v    any
+		opts []Option
+		want []byte
+	}{
+		{[]uint32{7}, nil, []byte{0xFF, 0x84, 0xB6, 0x01, 0x07, 0x00, 0x00, 0x00}},
+		{[]uint8{7}, nil, []byte{0x84, 0xB4, 0x01, 0x07}},
+		{[]any{uint8(1), []uint32{7}, []int16{2}}, nil, []byte{0x90, 0xA1,
+			0xFF, 0xFF, 0xFF, 0x84, 0xB6, 0x01, 0x07, 0x00, 0x00, 0x00,
+			0xFF, 0x84, 0xB1, 0x01, 0x02, 0x00, 0x91}},
+		// the position of arrays in tagged lists isn't known
+		{[]any{uint8(1), []uint32{7}}, []Option{WithSizeTags()}, []byte{0x8B, 0x0A, 0x90, 0xA1,
+			0x84, 0xB6, 0x01, 0x07, 0x00, 0x00, 0x00, 0x91}},
+		{[]uint32{7}, []Option{WithCanonical()}, []byte{0x84, 0xB6, 0x01, 0x07, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		b, err := Marshal(tt.v, append(tt.opts, WithAlignedArrays())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, b); diff != "" {
+			t.Errorf("%v: %s", tt.v, diff)
+		}
+		var got any
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.v, got); diff != "" {
+			t.Errorf("%v: %s", tt.v, diff)
+		}
+	}
+
+	// only the first chunk of a chunked array is aligned, and the magic and
+	// dictionary ID count towards the position
+	var buf bytes.Buffer
+	d := NewDictionary([]string{"x"})
+	e := NewEncoder(&buf, WithAlignedArrays(), WithSharedDictionary(d))
+	e.mw.TagMuon()
+	e.BeginArray(Float32Array)
+	e.ArrayChunk([]float32{1})
+	e.ArrayChunk([]float32{2})
+	if err := e.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	start := len(MuonMagic) + 1 + len(uleb128encodeUint(uint64(d.ID)))
+	if !bytes.HasPrefix(b[start:], []byte{0xFF}) {
+		t.Errorf("got % x, want padding after the dictionary ID", b)
+	}
+	if i := bytes.Index(b, []byte{0x85, 0xB9, 0x01}) + 3; i%4 != 0 {
+		t.Errorf("got % x, with the first chunk at offset %d", b, i)
+	}
+	var got []float32
+	if err := Unmarshal(b, &got, WithSharedDictionary(d)); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]float32{1, 2}, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestFloat16(t *testing.T) {
+	b, err := Marshal(Float16From(1.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]byte{0xB8, 0x00, 0x3E}, b); diff != "" {
+		t.Error(diff)
+	}
+	var got any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != Float16From(1.5) {
+		t.Errorf("got %v (%T), want Float16 1.5", got, got)
+	}
+
+	b, err = Marshal(map[string]any{
+		"F": Float16From(-2),
+		"A": []Float16{Float16From(0.25), Float16From(65504)},
+		"B": []Float16{Float16From(1)},
+		"C": 3.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		F float64
+		A []float32
+		B []Float16
+		C Float16
+	}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.F != -2 || !cmp.Equal(s.A, []float32{0.25, 65504}) || !cmp.Equal(s.B, []Float16{Float16From(1)}) || s.C != Float16From(3.5) {
+		t.Errorf("got %+v", s)
+	}
+
+	b, _ = Marshal(struct{ C float64 }{1e10})
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal(b, &s); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for 1e10 into a Float16, want *UnmarshalTypeError", err)
+	}
+}
+
+func TestCompactFloats(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want byte
+	}{
+		{0.5, 0xB8},
+		{-65504, 0xB8},
+		{math.Copysign(0, -1), 0xB8},
+		{1e10, 0xB9},
+		{0.1, 0xBA},
+		{1e300, 0xBA},
+	}
+	for _, tc := range tests {
+		b, err := Marshal(tc.in, WithCompactFloats())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != tc.want {
+			t.Errorf("%v encoded as %X, want tag %02X", tc.in, b, tc.want)
+		}
+		var got float64
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.in || math.Signbit(got) != math.Signbit(tc.in) {
+			t.Errorf("%v decoded as %v", tc.in, got)
+		}
+	}
+
+	if b, _ := Marshal(0.5); b[0] != 0xBA {
+		t.Errorf("0.5 encoded as %X without WithCompactFloats, want f64", b)
+	}
+}
+
+func TestFloatEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		opts []Option
+		want []byte
+	}{
+		{"NaN", math.NaN(), nil, []byte{0xAD}},
+		{"-Inf", math.Inf(-1), nil, []byte{0xAE}},
+		{"+Inf", math.Inf(1), nil, []byte{0xAF}},
+		{"float32 NaN", float32(math.NaN()), nil, []byte{0xAD}},
+		{"NaN in list", []any{math.NaN(), math.Inf(1)}, nil, []byte{0x90, 0xAD, 0xAF, 0x91}},
+		{"float32", float32(1.5), nil, []byte{0xB9, 0x00, 0x00, 0xC0, 0x3F}},
+		{"compact float32", float32(1.5), []Option{WithCompactFloats()}, []byte{0xB8, 0x00, 0x3E}},
+		{"compact Inf", math.Inf(1), []Option{WithCompactFloats()}, []byte{0xAF}},
+		{"integral", 3.0, []Option{WithIntegralFloats()}, []byte{0xA3}},
+		{"integral negative", float32(-5), []Option{WithIntegralFloats()}, []byte{0xB0, 0xFB}},
+		{"integral large", 100000.0, []Option{WithIntegralFloats()}, []byte{0xBB, 0xA0, 0x8D, 0x06}},
+		{"integral negative zero", math.Copysign(0, -1), []Option{WithIntegralFloats()}, append([]byte{0xBA}, f64bytes(math.Copysign(0, -1))...)},
+		{"integral beyond 2^53", 1e17, []Option{WithIntegralFloats(), WithCompactFloats()}, append([]byte{0xBA}, f64bytes(1e17)...)},
+		{"fraction", 0.5, []Option{WithIntegralFloats(), WithCompactFloats()}, []byte{0xB8, 0x00, 0x38}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Marshal(tc.in, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, b); diff != "" {
+				t.Error(diff)
+			}
+			if f, ok := tc.in.(float64); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				var got float64
+				if err := Unmarshal(b, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != f || math.Signbit(got) != math.Signbit(f) {
+					t.Errorf("got %v, want %v", got, f)
+				}
+			}
+		})
+	}
+}
+
+func TestBigInts(t *testing.T) {
+	huge, _ := new(big.Int).SetString("1267650600228229401496703205376", 10) // 2^100
+	neg, _ := new(big.Int).SetString("-1180591620717411303424", 10)          // -2^70
+
+	type nums struct {
+		A *big.Int
+		B big.Int
+		C *big.Int
+		D []*big.Int
+		E any
+	}
+	in := nums{A: huge, B: *neg, C: big.NewInt(5), D: []*big.Int{big.NewInt(100000), huge}, E: neg}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out nums
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.A.Cmp(huge) != 0 || out.B.Cmp(neg) != 0 || out.C.Cmp(big.NewInt(5)) != 0 ||
+		len(out.D) != 2 || out.D[0].Int64() != 100000 || out.D[1].Cmp(huge) != 0 {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+	if e, ok := out.E.(*big.Int); !ok || e.Cmp(neg) != 0 {
+		t.Errorf("got E %T %v, want *big.Int %v", out.E, out.E, neg)
+	}
+
+	b, _ = Marshal([]any{100000, huge})
+	var got []any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := got[0].(*big.Int); !ok || n.Int64() != 100000 {
+		t.Errorf("got %T %v, want *big.Int 100000", got[0], got[0])
+	}
+	if err := NewDecoder(bytes.NewReader(b), WithNativeInts()).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != int64(100000) {
+		t.Errorf("got %T %v with WithNativeInts, want int64 100000", got[0], got[0])
+	}
+	if n, ok := got[1].(*big.Int); !ok || n.Cmp(huge) != 0 {
+		t.Errorf("got %T %v with WithNativeInts, want *big.Int 2^100", got[1], got[1])
+	}
+
+	b, _ = Marshal("100")
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal(b, &out.A); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for a string into *big.Int, want *UnmarshalTypeError", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	type point struct {
+		Y float64 `muon:"y"`
+		X float64 `muon:"x"`
+		Z string  `muon:"z,omitempty"`
+	}
+	m := map[string]any{}
+	for i := 0; i < 50; i++ {
+		m[strconv.Itoa(i)] = map[string]int{"b": i, "a": -i}
+	}
+	want, err := Marshal(m, WithCanonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		got, _ := Marshal(m, WithCanonical())
+		if !bytes.Equal(got, want) {
+			t.Fatalf("canonical encodings differ:\n%x\n%x", got, want)
+		}
+	}
+
+	// a struct, a map and an OrderedMap with the same entries
+	want = []byte{0x92, 'x', 0x00, 0xB8, 0x00, 0x3C, 'y', 0x00, 0xB9}
+	want = binary.LittleEndian.AppendUint32(want, math.Float32bits(0.1))
+	want = append(want, 0x93)
+	for _, v := range []any{
+		point{X: 1, Y: float64(float32(0.1))},
+		map[string]float64{"y": float64(float32(0.1)), "x": 1},
+		OrderedMap{{"y", float64(float32(0.1))}, {"x", 1.0}},
+	} {
+		got, err := Marshal(v, WithCanonical())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got % x for %T, want % x", got, v, want)
+		}
+	}
+}
+
+// TestCanonicalTies checks that keys that compare equal, and keys of kinds
+// that aren't compared, are written in the same order every time.
+func TestCanonicalTies(t *testing.T) {
+	type pair struct{ A, B int }
+	m := map[any]any{
+		1:              "int",
+		1.0:            "float64",
+		uint8(1):       "uint8",
+		int64(1):       "int64",
+		Float16From(1): "float16",
+		math.NaN():     "nan",
+		[2]int{1, 2}:   "array",
+		[2]int{0, 5}:   "another array",
+		pair{1, 2}:     "struct",
+		pair{3, 4}:     "another struct",
+	}
+	m[math.NaN()] = "another nan"
+	want, err := Marshal(m, WithCanonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		got, err := Marshal(m, WithCanonical())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("canonical encodings differ:\n%x\n%x", got, want)
+		}
+	}
+}
+
+func TestMarshalCycles(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	n := &node{Name: "loop"}
+	n.Next = n
+	list := []any{1, nil}
+	list[1] = list
+	dict := map[string]any{"a": 1}
+	dict["self"] = dict
+	typed := map[string][]any{"a": nil}
+	typed["a"] = []any{typed}
+
+	for _, v := range []any{n, list, dict, typed} {
+		for _, opts := range [][]Option{nil, {WithCanonical()}} {
+			_, err := Marshal(v, opts...)
+			var uve *UnsupportedValueError
+			if !errors.As(err, &uve) || !strings.Contains(err.Error(), "cycle") {
+				t.Errorf("%T: got %v, want an UnsupportedValueError for a cycle", v, err)
+			}
+		}
+	}
+
+	// deep values that don't refer to themselves are fine, as are slices
+	// that hold a part of themselves
+	deep := &node{}
+	for i := 0; i < 2*startDetectingCyclesAfter; i++ {
+		deep = &node{Next: deep}
+	}
+	shared := make([]any, 2)
+	shared[0] = shared[1:]
+	for _, v := range []any{deep, shared} {
+		if _, err := Marshal(v); err != nil {
+			t.Errorf("%T: %v", v, err)
+		}
+	}
+}
+
+func TestUnmarshalTrailingData(t *testing.T) {
+	var v any
+	if err := Unmarshal([]byte{0xA1, 0xFF, 0xFF}, &v); err != nil || v != uint8(1) {
+		t.Errorf("got %v, %v with trailing padding, want 1", v, err)
+	}
+	var se *SyntaxError
+	for _, doc := range [][]byte{{0xA1, 0xA2}, {0xA1, 0xFF, 0x90, 0x91}, {0x90, 0x91, 0x00}} {
+		if err := Unmarshal(doc, &v); !errors.As(err, &se) {
+			t.Errorf("% x: got %v, want a SyntaxError for the trailing data", doc, err)
+		}
+	}
+}
+
+func TestNonStringKeys(t *testing.T) {
+	b, err := Marshal(map[int]string{300: "big", 1: "one", -2: "neg"}, WithCanonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x92, 0xB0, 0xFE, 'n', 'e', 'g', 0x00, 0xA1, 'o', 'n', 'e', 0x00, 0xB5, 0x2C, 0x01, 'b', 'i', 'g', 0x00, 0x93}
+	if diff := cmp.Diff(want, b); diff != "" {
+		t.Error(diff)
+	}
+
+	var ints map[int]string
+	if err := Unmarshal(b, &ints); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[int]string{300: "big", 1: "one", -2: "neg"}, ints); diff != "" {
+		t.Error(diff)
+	}
+	var got any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[any]any{int8(-2): "neg", uint8(1): "one", uint16(300): "big"}, got); diff != "" {
+		t.Error(diff)
+	}
+
+	// keys of different types in one dict, written with an Encoder
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.BeginDict()
+	e.Key("s")
+	e.Bool(false)
+	e.Bool(true)
+	e.Float(0.5)
+	e.Null()
+	e.Encode(big.NewInt(7))
+	e.Encode(uint64(1 << 40))
+	e.String("x")
+	if err := e.EndDict(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	// 1<<40 is shortest as LEB128, which reads as a *big.Int and keys as an int64
+	want2 := map[any]any{"s": false, true: 0.5, nil: uint8(7), int64(1 << 40): "x"}
+	if diff := cmp.Diff(want2, got); diff != "" {
+		t.Error(diff)
+	}
+	var s struct{ S bool }
+	if err := Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Errorf("got error %v, want the keys that aren't strings skipped", err)
+	}
+
+	for _, v := range []any{map[bool]int{true: 1, false: 0}, map[float64]string{0.5: "half"}, map[uint64]int{1 << 63: 1}} {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reflect.New(reflect.TypeOf(v))
+		if err := Unmarshal(b, got.Interface()); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(v, got.Elem().Interface()); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
+
+func TestNonStringKeyErrors(t *testing.T) {
+	var typeErr *UnmarshalTypeError
+	var strs map[string]int
+	if err := Unmarshal([]byte{0x92, 0xA1, 0xA2, 0x93}, &strs); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for an int key into map[string]int, want *UnmarshalTypeError", err)
+	}
+	var ints map[int]int
+	if err := Unmarshal([]byte{0x92, 'a', 0x00, 0xA2, 0x93}, &ints); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for a string key into map[int]int, want *UnmarshalTypeError", err)
+	}
+
+	// a list can be a key, but not of a map
+	doc := []byte{0x92, 0x90, 0xA1, 0x91, 0xA2, 0x93, 0xA3}
+	d := NewDecoder(bytes.NewReader(doc))
+	var got any
+	if err := d.Decode(&got); !errors.As(err, &typeErr) || typeErr.Offset != 1 {
+		t.Errorf("got error %v for a list key, want *UnmarshalTypeError at offset 1", err)
+	}
+	if err := d.Decode(&got); err != nil || got != uint8(3) {
+		t.Errorf("got %v, %v after the list key, want 3", got, err)
+	}
+	if err := Unmarshal(doc[:len(doc)-1], &got, WithOrderedMaps()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(OrderedMap{{[]any{uint8(1)}, uint8(2)}}, got); diff != "" {
+		t.Error(diff)
+	}
+}
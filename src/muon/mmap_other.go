@@ -0,0 +1,23 @@
+//go:build !unix
+
+package muon
+
+import (
+	"io"
+	"os"
+)
+
+const mmapSupported = false
+
+// mapFile reads the file into memory, where mapping it isn't supported.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -1,15 +1,24 @@
+// Package muon reads and writes MuON, a compact binary format for JSON-like
+// data: https://github.com/vshymanskyy/muon.
+//
+// Streams follow the MuON spec, apart from one extension: a stream written
+// with WithSharedDictionary starts with the tag 0x8D and the ID of the
+// dictionary, which readers of the spec don't know. No other option writes
+// anything outside the spec.
 package muon
 
 import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"math/big"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/x448/float16"
@@ -21,6 +30,8 @@ const MuonMagic = "\x8F\xB5\x30\x31"
 
 // NOTE: use zap logger
 
+// A DictBuilder counts the strings of one or more documents to pick the ones
+// worth adding to the LRU, for use with AddLRUDynamic or WithDictionary.
 type DictBuilder struct {
 	count map[string]int
 }
@@ -30,13 +41,19 @@ func NewDictBuilder() *DictBuilder {
 	return &DictBuilder{count: count}
 }
 
+// Reset forgets the strings counted so far.
+func (d *DictBuilder) Reset() {
+	d.count = make(map[string]int)
+}
+
 func (d *DictBuilder) AddStr(s string) {
-	// NOTE: why len(val) > 1 check in original code?
 	d.count[s]++
 }
 
+// Add counts the strings in x, a value as read by ReadObject or Decode into
+// an interface. Counts add up over calls, so a dictionary can be built for a
+// set of documents.
 func (d *DictBuilder) Add(x any) {
-	// fmt.Printf("val: %+v \t type: %T\n", x, x)
 	switch val := x.(type) {
 	case nil:
 		return
@@ -46,29 +63,104 @@ func (d *DictBuilder) Add(x any) {
 		for _, s := range val {
 			d.Add(s)
 		}
+	case []string:
+		for _, s := range val {
+			d.AddStr(s)
+		}
 	case map[string]any:
 		for k, v := range val {
 			d.AddStr(k)
 			d.Add(v)
 		}
+	case map[any]any:
+		for k, v := range val {
+			d.Add(k)
+			d.Add(v)
+		}
+	case OrderedMap:
+		for _, kv := range val {
+			d.Add(kv.Key)
+			d.Add(kv.Value)
+		}
 	}
 }
 
-func (d *DictBuilder) GetDict(size int) []string {
-	for k, v := range d.count {
-		d.count[k] = (v - 1) * len(k) // sets counts of 1 to 0?
+// savings returns the number of bytes that adding s to the LRU saves, if s
+// is the rank-th string added. The first copy costs an extra 0x8C tag and
+// every later one becomes a reference.
+func (d *DictBuilder) savings(s string, rank int) int {
+	return (d.count[s]-1)*(strCost(s)-refCost(rank)) - 1
+}
+
+// refCost returns the size of a reference to the rank-th string added to the
+// LRU: two bytes, or three from rank 128 on, where indexes no longer fit in
+// one LEB128 byte. That is an estimate, since the index of a reference
+// depends on how many strings were added after it by the time it is
+// written.
+func refCost(rank int) int {
+	if rank >= 128 {
+		return 3
 	}
+	return 2
+}
+
+// strCost returns the number of bytes s takes when written in full.
+func strCost(s string) int {
+	if strings.IndexByte(s, 0) >= 0 || len(s) >= 512 {
+		return 1 + len(uleb128encode(len(s))) + len(s)
+	}
+	return len(s) + 1
+}
 
+// GetDict returns up to size strings whose addition to the LRU is expected
+// to save bytes, the most valuable first. Strings that save the same number
+// of bytes are ordered by their bytes, so the result only depends on the
+// counts.
+func (d *DictBuilder) GetDict(size int) []string {
+	return d.top(size, d.savings)
+}
+
+// top returns up to size strings for which savings, given their rank, is
+// positive, in order of decreasing savings and then by their bytes.
+func (d *DictBuilder) top(size int, savings func(s string, rank int) int) []string {
 	res := make([]string, 0)
-	for k, v := range d.count {
-		if v > 5 {
+	for k := range d.count {
+		if savings(k, 0) > 0 {
 			res = append(res, k)
 		}
 	}
+	sort.Slice(res, func(i, j int) bool {
+		si, sj := savings(res[i], 0), savings(res[j], 0)
+		if si != sj {
+			return si > sj
+		}
+		return res[i] < res[j]
+	})
 	if len(res) > size {
 		res = res[:size]
 	}
-	return res
+	// Strings that only save bytes with a one byte index don't make it past
+	// rank 128.
+	kept := res[:0]
+	for _, s := range res {
+		if savings(s, len(kept)) > 0 {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// ExpectedSavings returns the number of bytes that adding the strings of
+// dict to the LRU, in order, is expected to save on the documents counted
+// when they are written to one stream.
+func (d *DictBuilder) ExpectedSavings(dict []string) int {
+	total := 0
+	for i, s := range dict {
+		if d.count[s] > 0 {
+			total += d.savings(s, i)
+		}
+	}
+	return total
 }
 
 // integer encoding
@@ -77,11 +169,17 @@ func uleb128encode(x int) []byte {
 	if x < 0 {
 		return []byte{}
 	}
+	return uleb128encodeUint(uint64(x))
+}
+
+// uleb128encodeUint is uleb128encode for values that may not fit in an int,
+// such as a uint32 on 32-bit machines.
+func uleb128encodeUint(x uint64) []byte {
 	r := make([]byte, 0)
 	for {
 		b := x & 0x7f
 		x >>= 7
-		if x == 0 { // NOTE:XXX: won't this always equal 0?
+		if x == 0 {
 			r = append(r, byte(b))
 			return r
 		}
@@ -97,24 +195,48 @@ func uleb128decode(b []byte) int {
 	return r
 }
 
+var errLEB128Overflow = errors.New("uleb128 value overflows")
+
 // TODO: change from reading 1 byte to reading 1 character
-func uleb128read(r *bufio.Reader) int {
+func uleb128read(r io.ByteReader) (int, error) {
 	a := make([]byte, 0)
 	for {
 		b, err := r.ReadByte()
 		if err != nil {
-			panic(err) // TODO: Real error handling
+			return 0, err
 		}
-		// log.Printf("next char: %x", b)
 		a = append(a, b)
+		// 9 groups of 7 bits is as much as fits in a non-negative int64
+		if len(a) > 9 {
+			return 0, errLEB128Overflow
+		}
 		if (b & 0x80) == 0 {
 			break
 		}
 	}
-	return uleb128decode(a)
+	return uleb128decode(a), nil
 }
 
-func sleb128encode(i int) []byte {
+// uleb128readUint is uleb128read for values that may not fit in an int. It
+// reads up to 10 bytes, as much as a uint64 takes.
+func uleb128readUint(r io.ByteReader) (uint64, error) {
+	var x uint64
+	for shift := 0; ; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if shift == 63 && b > 1 || shift > 63 {
+			return 0, errLEB128Overflow
+		}
+		x |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return x, nil
+		}
+	}
+}
+
+func sleb128encode(i int64) []byte {
 	r := make([]byte, 0)
 	for {
 		b := i & 0x7f
@@ -127,6 +249,27 @@ func sleb128encode(i int) []byte {
 	}
 }
 
+// sleb128encodeBig is sleb128encode for integers of any size.
+func sleb128encodeBig(i *big.Int) []byte {
+	if i.IsInt64() {
+		return sleb128encode(i.Int64())
+	}
+	r := make([]byte, 0)
+	x := new(big.Int).Set(i)
+	b := new(big.Int)
+	mask := big.NewInt(0x7f)
+	for {
+		// Rsh rounds towards negative infinity, so this is an arithmetic
+		// shift like >> on an int.
+		v := b.And(x, mask).Int64()
+		x.Rsh(x, 7)
+		if (x.Sign() == 0 && v&0x40 == 0) || (x.Cmp(big.NewInt(-1)) == 0 && v&0x40 != 0) {
+			return append(r, byte(v))
+		}
+		r = append(r, byte(0x80|v))
+	}
+}
+
 func sleb128decode(b []byte) *big.Int {
 	r := big.NewInt(0)
 	var i int
@@ -147,19 +290,19 @@ func sleb128decode(b []byte) *big.Int {
 	return r
 }
 
-func sleb128read(r *bufio.Reader) *big.Int {
+func sleb128read(r io.ByteReader) (*big.Int, error) {
 	a := make([]byte, 0)
 	for {
 		b, err := r.ReadByte()
 		if err != nil {
-			panic(err) // TODO: error handling
+			return nil, err
 		}
 		a = append(a, b)
 		if (b & 0x80) == 0 {
 			break
 		}
 	}
-	return sleb128decode(a)
+	return sleb128decode(a), nil
 }
 
 // Array helpers
@@ -169,179 +312,172 @@ func getTypeWidth(typeCode byte) int {
 	switch typeCode {
 	case 0xB0, 0xB4: // i8, u8
 		width = 1
-	case 0xB1, 0xB5: // i16, u16
+	case 0xB1, 0xB5, 0xB8: // i16, u16, f16
 		width = 2
-	case 0xB9: // f32, encoded as 4 bytes!
+	case 0xB2, 0xB6, 0xB9: // i32, u32, f32
 		width = 4
-	case 0xB2, 0xB6: //i32, u32
-		// HACK: it seems like 32 bits are encoded with 8 bytes in Python implementation?
-		// width = 4 // this doesn't work!
-		width = 8
 	case 0xB3, 0xB7, 0xBA: // i64, u64, f64
 		width = 8
-	case 0xB8:
-		panic("TypedArray: f16 not supported") //TODO: error handling
-	default:
-		panic("No array for type")
 	}
+	// width is 0 for codes that have no typed array
 	return width
 }
 
-func readBitsAs(typeCode byte, bits []byte) any {
+// decodeArray decodes the little-endian elements of a typed array of type
+// typeCode into a slice of the matching Go type, e.g. []int16 for 0xB1.
+func decodeArray(typeCode byte, data []byte) any {
 	width := getTypeWidth(typeCode)
-	bits = bits[:width]
+	n := len(data) / width
+	le := binary.LittleEndian
 	switch typeCode {
 	case 0xB0: // i8
-		return int8(bits[0])
+		res := make([]int8, n)
+		for i := range res {
+			res[i] = int8(data[i])
+		}
+		return res
 	case 0xB1: // i16
-		return int16(binary.LittleEndian.Uint16(bits))
+		res := make([]int16, n)
+		for i := range res {
+			res[i] = int16(le.Uint16(data[i*width:]))
+		}
+		return res
 	case 0xB2: // i32
-		return int32(binary.LittleEndian.Uint32(bits))
+		res := make([]int32, n)
+		for i := range res {
+			res[i] = int32(le.Uint32(data[i*width:]))
+		}
+		return res
 	case 0xB3: // i64
-		return int64(binary.LittleEndian.Uint64(bits))
+		res := make([]int64, n)
+		for i := range res {
+			res[i] = int64(le.Uint64(data[i*width:]))
+		}
+		return res
 	case 0xB4: // u8
-		return uint8(bits[0])
+		return data
 	case 0xB5: // u16
-		return binary.LittleEndian.Uint16(bits)
+		res := make([]uint16, n)
+		for i := range res {
+			res[i] = le.Uint16(data[i*width:])
+		}
+		return res
 	case 0xB6: // u32
-		return binary.LittleEndian.Uint32(bits)
+		res := make([]uint32, n)
+		for i := range res {
+			res[i] = le.Uint32(data[i*width:])
+		}
+		return res
 	case 0xB7: // u64
-		return binary.LittleEndian.Uint64(bits)
-
+		res := make([]uint64, n)
+		for i := range res {
+			res[i] = le.Uint64(data[i*width:])
+		}
+		return res
 	case 0xB8: // f16
-		panic("TypedArray: f16 not supported") //TODO: error handling
+		res := make([]Float16, n)
+		for i := range res {
+			res[i] = Float16FromBits(le.Uint16(data[i*width:]))
+		}
+		return res
 	case 0xB9: // f32
-		return math.Float32frombits(binary.LittleEndian.Uint32(bits))
+		res := make([]float32, n)
+		for i := range res {
+			res[i] = math.Float32frombits(le.Uint32(data[i*width:]))
+		}
+		return res
 	case 0xBA: // f64
-		return math.Float64frombits(binary.LittleEndian.Uint64(bits))
-	default:
-		// err := errors.New(fmt.Sprintf("No array type for %x", t))
-		panic("No array for type")
-	}
-}
-
-func readArrayFromBits(typeCode byte, data []byte) any {
-	width := getTypeWidth(typeCode)
-	ret := make([]any, 0)
-
-	for i := 0; i < len(data); i += width {
-		v := readBitsAs(typeCode, data[i:i+width])
-		ret = append(ret, v)
-	}
-	return ret
-}
-
-func getTypedArrayMarker(val any) byte {
-	switch t := val.(type) {
-	case int8:
-		return 0xB0
-	case int16:
-		return 0xB1
-	case int32:
-		return 0xB2
-	case int64:
-		return 0xB3
-
-	case uint8:
-		return 0xB4
-	case uint16:
-		return 0xB5
-	case uint32:
-		return 0xB6
-	case uint64:
-		return 0xB7
-
-	case float32:
-		return 0xB9
-	case float64:
-		return 0xBA
+		res := make([]float64, n)
+		for i := range res {
+			res[i] = math.Float64frombits(le.Uint64(data[i*width:]))
+		}
+		return res
 	default:
-		err := fmt.Errorf("no encoding for array %x", t)
-		panic(err)
+		panic(fmt.Sprintf("no array for type 0x%02X", typeCode))
 	}
 }
 
 // Muon formatter and parser
 
+// muWriter errors are sticky: after the first failed write or unsupported
+// value, all further calls are no-ops that return the same error, like
+// bufio.Writer.
 type muWriter struct {
-	out          io.ReadWriter
+	out          io.Writer
 	lru          *LRU
 	lruDynamic   *LRU
 	detectArrays bool
+	err          error
+	enc          *Encoder
+	opts         options
+	dictPending  bool        // the ID of the shared dictionary is yet to be written
+	held         []io.Writer // outputs of the lists and dicts held back by beginTagged
+	off          int64       // bytes written to out, while nothing is held back
+	arrayHeader  []byte      // header of a typed array whose first chunk is yet to be written
+	depth        int         // pointers, maps and slices being written, one inside the other
+	seen         map[cycleKey]bool
 }
 
-func NewMuWriter(f io.ReadWriter) *muWriter {
-	lru := NewLRU(512)
-	lruDynamic := NewLRU(512)
-	return &muWriter{f, lru, lruDynamic, true}
+func NewMuWriter(f io.Writer, opts ...Option) *muWriter {
+	o := newOptions(opts)
+	lru := NewLRU(o.lruSize)
+	lruDynamic := NewLRU(o.dynamicLRUSize)
+	if o.lruSize <= 0 {
+		// strings added to the LRU would never be referred to
+		lruDynamic = NewLRU(0)
+	}
+	mw := &muWriter{out: f, lru: lru, lruDynamic: lruDynamic, detectArrays: true, opts: o}
+	dict := o.dictionary
+	if len(dict) > lruDynamic.cap {
+		dict = dict[:lruDynamic.cap]
+	}
+	mw.AddLRUDynamic(dict)
+	if o.shared != nil {
+		o.shared.load(mw.lru)
+		mw.dictPending = true
+	}
+	return mw
 }
 
-func (mw *muWriter) TagMuon() {
-	mw.write([]byte(MuonMagic))
+// Err returns the first error encountered by the writer, if any.
+func (mw *muWriter) Err() error {
+	return mw.err
 }
 
-// func (mw *muWriter) addTagged(val string, size bool, count bool, pad int) {
-// 	ogOut := mw.out
-
-// 	// encode to a temporary buffer
-// 	mw.out = bytes.NewBufferString("")
-// 	mw.Add(val)
-// 	out, ok := mw.out.(*bytes.Buffer)
-// 	if !ok {
-// 		panic("Couldn't type assert!")
-// 	}
-// 	buf := make([]byte, len(out.Bytes()))
-// 	n, err := mw.out.Read(buf)
-// 	if err != nil {
-// 		panic(errors.New(fmt.Sprintf("ERROR: failed to read from buffer: %s. %v bytes read", err, n)))
-// 	}
-// 	mw.out = ogOut
-
-// 	if pad > 0 {
-// 		padding := make([]byte, 0)
-// 		for i := 0; i < pad; i++ {
-// 			padding = append(padding, byte(0xFF))
-// 		}
-// 		mw.write(padding)
-// 	}
-
-// 	if count {
-// 		b := []byte{0x8A}
-// 		enc := uleb128encode(len(val))
-// 		for _, x := range enc {
-// 			b = append(b, x)
-// 		}
-
-// 		mw.write(b)
-// 	}
-
-// 	if size {
-// 		b := []byte{0x8B}
-// 		enc := uleb128encode(len(buf))
-// 		for _, x := range enc {
-// 			b = append(b, x)
-// 		}
-
-// 		mw.write(b)
-// 	}
-// }
+func (mw *muWriter) TagMuon() error {
+	mw.writeOut([]byte(MuonMagic))
+	return mw.err
+}
 
-func (mw *muWriter) AddLRUDynamic(table []any) {
-	mw.lruDynamic.Extend(table)
+func (mw *muWriter) AddLRUDynamic(table []string) {
+	for _, s := range table {
+		mw.lruDynamic.Append(s)
+	}
 }
 
-func (mw *muWriter) AddLRUList(table []any) {
-	mw.lru.Extend(table)
+func (mw *muWriter) AddLRUList(table []string) error {
+	if mw.err != nil {
+		return mw.err
+	}
+	for _, s := range table {
+		mw.lru.Append(s)
+	}
 
-	mw.write([]byte{0x8C})
-	mw.startList()
+	// the list is read as part of the 0x8C tag, so it never gets tags
+	mw.write([]byte{0x8C, 0x90})
 	for _, s := range table {
-		mw.write(append([]byte(s.(string)), 0x00))
+		mw.write(append([]byte(s), 0x00))
 	}
-	mw.endList()
+	mw.append(0x91)
+	return mw.err
 }
 
-func (mw *muWriter) Add(value any) {
+// Add writes value to the output. Values of types the writer can't encode
+// produce an error wrapping ErrUnsupportedType.
+func (mw *muWriter) Add(value any) error {
+	if mw.err != nil {
+		return mw.err
+	}
 	switch val := value.(type) {
 	case string:
 		mw.addStr(val)
@@ -356,102 +492,102 @@ func (mw *muWriter) Add(value any) {
 		}
 		mw.write([]byte{b})
 	case int:
-		if val >= 0 && val <= 9 {
-			mw.write([]byte{byte(0xA0 + val)})
-		} else {
-			enc := sleb128encode(val)
-			lenc := len(enc)
-			if val < 0 {
-				switch {
-				case val >= -0x80:
-					mw.write([]byte{0xB0, byte(int8(val))})
-				case val >= -0x8000 && lenc >= 2:
-					mw.write([]byte{0xB1, byte(int16(val))})
-				case val >= -0x8000_0000 && lenc >= 4:
-					mw.write([]byte{0xB2, byte(int32(val))})
-				case val >= -0x8000_0000_0000_0000 && lenc >= 8:
-					mw.write([]byte{0xB3, byte(int64(val))})
-				default:
-					mw.write(append([]byte{0xBB}, enc...))
-				}
-			} else {
-				switch {
-				case val < 0x80:
-					mw.write([]byte{0xB4, byte(uint8(val))})
-				case val < 0x8000 && lenc >= 2:
-					mw.write([]byte{0xB5, byte(uint16(val))})
-				case val < 0x8000_0000 && lenc >= 4:
-					mw.write([]byte{0xB6, byte(uint32(val))})
-				case val < 0x7FFF_FFFF_FFFF_FFFF && lenc >= 8:
-					mw.write([]byte{0xB7, byte(uint64(val))})
-				default:
-					mw.write(append([]byte{0xBB}, enc...))
-				}
-			}
-		}
-	case float64: //TODO: handle float16, float32
-		if math.IsNaN(val) {
-			mw.write([]byte{0xAD})
-			return
+		mw.addInt(int64(val))
+	case int8:
+		mw.addInt(int64(val))
+	case int16:
+		mw.addInt(int64(val))
+	case int32:
+		mw.addInt(int64(val))
+	case int64:
+		mw.addInt(val)
+	case uint:
+		mw.addUint(uint64(val))
+	case uint8:
+		mw.addUint(uint64(val))
+	case uint16:
+		mw.addUint(uint64(val))
+	case uint32:
+		mw.addUint(uint64(val))
+	case uint64:
+		mw.addUint(val)
+	case *big.Int:
+		if val == nil {
+			mw.write([]byte{0xAC})
+			break
 		}
-		if math.IsInf(val, 0) {
-			var b byte
-			if val < 0 {
-				b = 0xAE
-			} else {
-				b = 0xAF
-			}
-			mw.write([]byte{b})
-		}
-
-		mw.write(binary.LittleEndian.AppendUint64([]byte{0xBA}, math.Float64bits(val)))
-	case []string: // TODO: handle different types of arrays
-		code := getTypedArrayMarker(val)
-		mw.write([]byte{0x84, code})
-		mw.write(uleb128encode(len(val)))
-		// TODO: handle big endian machines
-		n, err := io.WriteString(mw.out, strings.Join(val, ""))
-		if err != nil {
-			panic(fmt.Errorf("ERROR: failed to write to output: %s. %v bytes written", err, n))
-		}
-	case []byte:
-		mw.write([]byte{0x84, 0xB4})
-		mw.write(uleb128encode(len(val)))
-		mw.write(val)
-	case []int:
-		mw.write([]byte{0x84, 0xBB})
-		mw.write(uleb128encode(len(val)))
+		mw.addBigInt(val)
+	case Float16:
+		mw.write(binary.LittleEndian.AppendUint16([]byte{0xB8}, val.Bits()))
+	case float32:
+		mw.addFloat(float64(val), 32)
+	case float64:
+		mw.addFloat(val, 64)
+	case []string:
+		mw.startList()
 		for _, v := range val {
-			mw.write(sleb128encode(v))
-		}
-		return
-	case []float32, []float64:
-		if mw.detectArrays {
-			mw.Add(val) // NOTE: infinite recursion?
-			return
+			mw.addStr(v)
 		}
+		mw.endList(len(val))
+	case []byte, []int8, []int16, []int32, []int64, []int, []uint16, []uint32, []uint64, []Float16, []float32, []float64:
+		mw.addArray(sliceArrayTypes[reflect.TypeOf(val)], val)
 	case []any:
+		if !mw.enter(reflect.ValueOf(val)) {
+			break
+		}
 		mw.startList()
 		for _, v := range val {
 			mw.Add(v)
 		}
-		mw.endList()
+		mw.endList(len(val))
+		mw.leave(reflect.ValueOf(val))
 	case map[string]any:
+		if mw.opts.canonical {
+			mw.addValue(reflect.ValueOf(val))
+			break
+		}
+		if !mw.enter(reflect.ValueOf(val)) {
+			break
+		}
 		mw.startDict()
 		for k, v := range val {
 			mw.addStr(k)
 			mw.Add(v)
 		}
-		mw.endDict()
+		mw.endDict(len(val))
+		mw.leave(reflect.ValueOf(val))
+	default:
+		mw.addValue(reflect.ValueOf(value))
 	}
-	// return
+	return mw.err
 }
 
+// write writes b, after the ID of the shared dictionary if that hasn't been
+// written yet.
 func (mw *muWriter) write(b []byte) {
+	mw.writeDictID()
+	mw.writeOut(b)
+}
+
+func (mw *muWriter) writeDictID() {
+	if mw.dictPending {
+		mw.dictPending = false
+		mw.writeOut(append([]byte{0x8D}, uleb128encodeUint(uint64(mw.opts.shared.ID))...))
+	}
+}
+
+func (mw *muWriter) writeOut(b []byte) {
+	if mw.err != nil {
+		return
+	}
 	n, err := mw.out.Write(b)
-	if err != nil {
-		panic(fmt.Errorf("ERROR: failed to write to buffer: %s. %v bytes written", err, n))
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	if len(mw.held) == 0 {
+		mw.off += int64(n)
 	}
+	mw.err = err
 }
 
 // Low-level API
@@ -460,11 +596,13 @@ func (mw *muWriter) addStr(value any) {
 	val := value.(string)
 
 	valIdx := mw.lru.FindIndex(val)
-	if valIdx >= 0 { // TODO: use map to check membership
-		idx := len(mw.lru.deque) - valIdx - 1
+	if valIdx >= 0 {
+		idx := mw.lru.Len() - valIdx - 1
 		mw.write(append([]byte{0x81}, uleb128encode(idx)...))
 	} else {
-		if mw.lruDynamic.FindIndex(val) >= 0 {
+		// Strings added to the LRU inside a value with a size tag would be
+		// missed by readers that skip it.
+		if !mw.opts.sizeTags && mw.lruDynamic.FindIndex(val) >= 0 {
 			mw.lru.Append(val)
 			mw.lruDynamic.Remove(val)
 			mw.write([]byte{0x8C})
@@ -476,70 +614,395 @@ func (mw *muWriter) addStr(value any) {
 			mw.write(uleb128encode(len(val)))
 			mw.write([]byte(val))
 		} else {
+			if mw.opts.sizeTags && len(val) >= sizeTagMinString {
+				mw.write(append([]byte{0x8B}, uleb128encode(len(val)+1)...))
+			}
 			mw.write(append([]byte(val), 0x00))
 		}
 	}
 
 }
 
+// sizeTagMinString is the length from which strings get size tags. Reading
+// through shorter strings costs less than the tag.
+const sizeTagMinString = 64
+
+// addInt writes an integer in the smallest form the format has for it. For
+// values above 9 that is a fixed width integer of the smallest size that
+// holds the value, unless the LEB128 form is shorter, which it is for
+// values that need only a few bits of a wide type.
+func (mw *muWriter) addInt(val int64) {
+	if val >= 0 {
+		mw.addUint(uint64(val))
+		return
+	}
+	enc := sleb128encode(val)
+	lenc := len(enc)
+	le := binary.LittleEndian
+	switch {
+	case val >= math.MinInt8:
+		mw.write([]byte{0xB0, byte(val)})
+	case val >= math.MinInt16 && lenc >= 2:
+		mw.write(le.AppendUint16([]byte{0xB1}, uint16(val)))
+	case val >= math.MinInt32 && lenc >= 4:
+		mw.write(le.AppendUint32([]byte{0xB2}, uint32(val)))
+	case lenc >= 8:
+		mw.write(le.AppendUint64([]byte{0xB3}, uint64(val)))
+	default:
+		mw.write(append([]byte{0xBB}, enc...))
+	}
+}
+
+// addUint is addInt for unsigned values, which may be above math.MaxInt64.
+func (mw *muWriter) addUint(val uint64) {
+	if val <= 9 {
+		mw.write([]byte{byte(0xA0 + val)})
+		return
+	}
+	lenc := 10 // LEB128 of anything above MaxInt64
+	var enc []byte
+	if val <= math.MaxInt64 {
+		enc = sleb128encode(int64(val))
+		lenc = len(enc)
+	}
+	le := binary.LittleEndian
+	switch {
+	case val <= math.MaxUint8:
+		mw.write([]byte{0xB4, byte(val)})
+	case val <= math.MaxUint16 && lenc >= 2:
+		mw.write(le.AppendUint16([]byte{0xB5}, uint16(val)))
+	case val <= math.MaxUint32 && lenc >= 4:
+		mw.write(le.AppendUint32([]byte{0xB6}, uint32(val)))
+	case lenc >= 8:
+		mw.write(le.AppendUint64([]byte{0xB7}, val))
+	default:
+		mw.write(append([]byte{0xBB}, enc...))
+	}
+}
+
+// addBigInt writes integers that don't fit in 64 bits as LEB128, and others
+// like addInt.
+func (mw *muWriter) addBigInt(val *big.Int) {
+	switch {
+	case val.IsInt64():
+		mw.addInt(val.Int64())
+	case val.IsUint64():
+		mw.addUint(val.Uint64())
+	default:
+		mw.write(append([]byte{0xBB}, sleb128encodeBig(val)...))
+	}
+}
+
+// addFloat writes a float that came from a Go float of the given size in
+// bits. NaN and the infinities have tags of their own; other values are
+// written as ints or narrower floats if the writer's options allow it and
+// nothing is lost.
+func (mw *muWriter) addFloat(val float64, bits int) {
+	switch {
+	case math.IsNaN(val):
+		mw.write([]byte{0xAD})
+		return
+	case math.IsInf(val, -1):
+		mw.write([]byte{0xAE})
+		return
+	case math.IsInf(val, 1):
+		mw.write([]byte{0xAF})
+		return
+	}
+	if mw.opts.integralFloats && val == math.Trunc(val) && math.Abs(val) <= 1<<53 && !(val == 0 && math.Signbit(val)) {
+		mw.addInt(int64(val))
+		return
+	}
+	if mw.opts.compactFloats {
+		if f16 := float16.Fromfloat32(float32(val)); float64(f16.Float32()) == val {
+			mw.write(binary.LittleEndian.AppendUint16([]byte{0xB8}, f16.Bits()))
+			return
+		}
+	}
+	if mw.opts.compactFloats || bits == 32 {
+		if f32 := float32(val); float64(f32) == val {
+			mw.write(binary.LittleEndian.AppendUint32([]byte{0xB9}, math.Float32bits(f32)))
+			return
+		}
+	}
+	mw.write(binary.LittleEndian.AppendUint64([]byte{0xBA}, math.Float64bits(val)))
+}
+
 func (mw *muWriter) append(b byte) {
 	mw.write([]byte{b})
 }
 
-func (mw *muWriter) startList() { mw.append(0x90) }
-func (mw *muWriter) endList()   { mw.append(0x91) }
-func (mw *muWriter) startDict() { mw.append(0x92) }
-func (mw *muWriter) endDict()   { mw.append(0x93) }
+func (mw *muWriter) startList() { mw.beginTagged(); mw.append(0x90) }
+func (mw *muWriter) startDict() { mw.beginTagged(); mw.append(0x92) }
 
-// func (mw *muWriter) startArray(val []any, chunked bool) {
-// 	code := getTypedArrayMarker(val)
-// 	var b byte
-// 	if chunked {
-// 		b = 0x85
-// 	} else {
-// 		b = 0x84
-// 	}
-// 	mw.write([]byte{b, code})
-// 	mw.addArrayChunk(val)
-// }
+// endList and endDict end the list or dict with n elements or entries.
+func (mw *muWriter) endList(n int) { mw.append(0x91); mw.endTagged(n) }
+func (mw *muWriter) endDict(n int) { mw.append(0x93); mw.endTagged(n) }
 
-// func (mw *muWriter) addArrayChunk(val []any) {
-// 	mw.write(uleb128encode(len(val)))
-// 	// TODO: handle BIG_ENDIAN
-// 	for _, v := range val {
-// 		mw.write([]byte{v.(byte)})
-// 	}
-// }
+// beginTagged starts holding back a list or dict when size or count tags are
+// on, so that they can be written in front of it once it is complete.
+func (mw *muWriter) beginTagged() {
+	if !mw.opts.sizeTags && !mw.opts.countTags {
+		return
+	}
+	// the ID of the shared dictionary goes in front of the tags
+	mw.writeDictID()
+	mw.held = append(mw.held, mw.out)
+	mw.out = new(bytes.Buffer)
+}
 
-// func (mw *muWriter) endArrayChunked() {
-// 	mw.append(0x00)
-// }
+// endTagged writes the tags of the list or dict begun by beginTagged,
+// followed by the list or dict.
+func (mw *muWriter) endTagged(n int) {
+	if !mw.opts.sizeTags && !mw.opts.countTags {
+		return
+	}
+	buf := mw.out.(*bytes.Buffer)
+	mw.out = mw.held[len(mw.held)-1]
+	mw.held = mw.held[:len(mw.held)-1]
+	var tags []byte
+	if mw.opts.countTags {
+		tags = append(append(tags, 0x8A), uleb128encode(n)...)
+	}
+	if mw.opts.sizeTags {
+		tags = append(append(tags, 0x8B), uleb128encode(buf.Len())...)
+	}
+	mw.write(tags)
+	mw.write(buf.Bytes())
+}
 
-//TODO: handle float16
-// func (mw *muWriter) addTypedArrayF16(val []float64) {
-// 	mw.write([]byte{0x84, 0xB8})
-// 	mw.write(uleb128encode(len(val)))
-// 	for _, v := range val {
-// 		mw.write()
-// 	}
-// }
+// offsetReader wraps a bufio.Reader and counts the bytes consumed from it, so
+// that errors can report where in the input they were detected.
+//
+// If ra is set, the bufio.Reader reads from ra at off, and Discard jumps
+// over what isn't buffered instead of reading it. If data is set instead of
+// rd, the input is data, and next returns parts of it without copying.
+type offsetReader struct {
+	rd   *bufio.Reader
+	off  int64
+	ra   io.ReaderAt
+	data []byte
+}
+
+// newReaderAtReader returns an offsetReader over ra, starting at offset 0.
+func newReaderAtReader(ra io.ReaderAt) *offsetReader {
+	return &offsetReader{rd: bufio.NewReader(io.NewSectionReader(ra, 0, math.MaxInt64)), ra: ra}
+}
+
+// newDataReader returns an offsetReader over data.
+func newDataReader(data []byte) *offsetReader {
+	return &offsetReader{data: data}
+}
+
+// rest returns the unread part of data.
+func (r *offsetReader) rest() []byte {
+	return r.data[r.off:]
+}
+
+func (r *offsetReader) ReadByte() (byte, error) {
+	if r.rd == nil {
+		if len(r.rest()) == 0 {
+			return 0, io.EOF
+		}
+		r.off++
+		return r.data[r.off-1], nil
+	}
+	b, err := r.rd.ReadByte()
+	if err == nil {
+		r.off++
+	}
+	return b, err
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	if r.rd == nil {
+		if len(r.rest()) == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, r.rest())
+		r.off += int64(n)
+		return n, nil
+	}
+	n, err := r.rd.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) Peek(n int) ([]byte, error) {
+	if r.rd == nil {
+		if rest := r.rest(); len(rest) < n {
+			return rest, io.EOF
+		}
+		return r.rest()[:n], nil
+	}
+	return r.rd.Peek(n)
+}
+
+func (r *offsetReader) Discard(n int) (int, error) {
+	if r.rd == nil {
+		if rest := r.rest(); len(rest) < n {
+			r.off += int64(len(rest))
+			return len(rest), io.EOF
+		}
+		r.off += int64(n)
+		return n, nil
+	}
+	if r.ra != nil && n > r.rd.Buffered() {
+		return r.seek(n)
+	}
+	n, err := r.rd.Discard(n)
+	r.off += int64(n)
+	return n, err
+}
+
+// next consumes the next n bytes of data and returns them, with their
+// capacity limited so that appending to them can't overwrite data.
+func (r *offsetReader) next(n int) ([]byte, error) {
+	rest := r.rest()
+	if len(rest) < n {
+		r.off += int64(len(rest))
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.off += int64(n)
+	return rest[:n:n], nil
+}
+
+// seek moves n bytes forward in ra, dropping the buffered input. It reads
+// the last byte skipped, so that skipping past the end of the input fails
+// as Discard does.
+func (r *offsetReader) seek(n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	off := r.off + int64(n)
+	if _, err := r.ra.ReadAt(make([]byte, 1), off-1); err != nil {
+		return 0, err
+	}
+	r.rd.Reset(io.NewSectionReader(r.ra, off, math.MaxInt64-off))
+	r.off = off
+	return n, nil
+}
+
+func (r *offsetReader) Reset(rd io.Reader) {
+	if r.rd == nil {
+		r.rd = bufio.NewReader(rd)
+	} else {
+		r.rd.Reset(rd)
+	}
+	r.off = 0
+	r.ra = nil
+	r.data = nil
+}
 
 type muReader struct {
-	inp *bufio.Reader
-	lru *LRU
+	inp      *offsetReader
+	lru      *LRU
+	dec      *Decoder
+	opts     options
+	dictSeen bool      // the stream has named the shared dictionary
+	tags     valueTags // the last count and size tags read
+	borrow   bool      // strings and typed arrays share memory with inp.data
 }
 
-func NewMuReader(inp bufio.Reader) *muReader {
+func NewMuReader(inp bufio.Reader, opts ...Option) *muReader {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	return &muReader{&inp, NewLRU(512)} //NOTE: what should capacity of LRU be?
+	return newMuReader(&offsetReader{rd: &inp}, newOptions(opts))
+}
+
+func newMuReader(inp *offsetReader, o options) *muReader {
+	mr := &muReader{inp: inp, lru: NewLRU(o.lruSize), opts: o, tags: valueTags{off: -1}}
+	mr.borrow = o.borrowed && inp.data != nil
+	if o.shared != nil {
+		o.shared.load(mr.lru)
+	}
+	return mr
+}
+
+func (mr *muReader) syntaxError(tag byte, err error, msg string) error {
+	return &SyntaxError{Offset: mr.inp.off, Tag: tag, Err: err, msg: msg}
+}
+
+// wrapErr turns running out of input in the middle of a value into a
+// SyntaxError. Other errors are returned unchanged.
+func (mr *muReader) wrapErr(tag byte, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return mr.syntaxError(tag, ErrUnexpectedEOF, "unexpected EOF")
+	}
+	return err
 }
 
-func (mr *muReader) peekByte() byte {
+func (mr *muReader) peekByte() (byte, error) {
 	b, err := mr.inp.Peek(1)
 	if err != nil {
-		panic(err) //TODO: err handling
+		return 0, err
 	}
-	return b[0]
+	return b[0], nil
+}
+
+func (mr *muReader) readByte(tag byte) (byte, error) {
+	b, err := mr.inp.ReadByte()
+	if err != nil {
+		return 0, mr.wrapErr(tag, err)
+	}
+	return b, nil
+}
+
+// readFull reads exactly n bytes. Large lengths come straight from the input,
+// so they are read incrementally instead of being trusted for an allocation.
+func (mr *muReader) readFull(tag byte, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, mr.syntaxError(tag, nil, "negative length")
+	}
+	if mr.inp.data != nil {
+		b, err := mr.inp.next(n)
+		if err != nil {
+			return nil, mr.wrapErr(tag, err)
+		}
+		if mr.borrow {
+			return b, nil
+		}
+		return bytes.Clone(b), nil
+	}
+	if n <= 1<<16 {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(mr.inp, b); err != nil {
+			return nil, mr.wrapErr(tag, err)
+		}
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, mr.inp, int64(n)); err != nil {
+		return nil, mr.wrapErr(tag, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// string returns b as a string. If the reader borrows from its input, the
+// string shares memory with b.
+func (mr *muReader) string(b []byte) string {
+	if mr.borrow {
+		return borrowString(b)
+	}
+	return string(b)
+}
+
+func (mr *muReader) readUleb(tag byte) (int, error) {
+	n, err := uleb128read(mr.inp)
+	if err == errLEB128Overflow {
+		return 0, mr.syntaxError(tag, nil, err.Error())
+	}
+	if err != nil {
+		return 0, mr.wrapErr(tag, err)
+	}
+	return n, nil
+}
+
+func (mr *muReader) readSleb(tag byte) (*big.Int, error) {
+	n, err := sleb128read(mr.inp)
+	if err != nil {
+		return nil, mr.wrapErr(tag, err)
+	}
+	return n, nil
 }
 
 // NOTE: not used?
@@ -547,385 +1010,737 @@ func (mr *muReader) peekByte() byte {
 // 	return mr.inp.Buffered() > 0
 // }
 
-func (mr *muReader) readString() (res string) {
-	c, err := mr.inp.ReadByte()
+func (mr *muReader) readString() (string, error) {
+	c, err := mr.readByte(0)
 	if err != nil {
-		panic(err) // TODO: err handling
+		return "", err
 	}
-	// log.Printf("next char: %x", c)
 	switch c {
 	case 0x81: // string in LRU
-		n := uleb128read(mr.inp)
-		res = mr.lru.Get(-n).(string)
-		return
+		n, err := mr.readUleb(c)
+		if err != nil {
+			return "", err
+		}
+		if n >= mr.lru.cap {
+			return "", mr.syntaxError(c, nil, fmt.Sprintf("LRU index %d beyond the reader's LRU size of %d", n, mr.lru.cap))
+		}
+		if n >= mr.lru.Len() {
+			return "", mr.syntaxError(c, nil, fmt.Sprintf("LRU index %d out of range", n))
+		}
+		res, ok := mr.lru.Get(-n).(string)
+		if !ok {
+			return "", mr.syntaxError(c, nil, "LRU entry is not a string")
+		}
+		return res, nil
 	case 0x82: // string not in LRU?
-		n := uleb128read(mr.inp)
-		b := make([]byte, n)
-		_, err := mr.inp.Read(b)
+		n, err := mr.readUleb(c)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return "", err
 		}
-		return string(b)
+		b, err := mr.readFull(c, n)
+		if err != nil {
+			return "", err
+		}
+		return mr.string(b), nil
 	default: // null terminated UTF-8 string
+		tag := c
+		if mr.inp.data != nil {
+			mr.inp.off--
+			n := bytes.IndexByte(mr.inp.rest(), 0x00)
+			if n < 0 {
+				mr.inp.off += int64(len(mr.inp.rest()))
+				return "", mr.wrapErr(tag, io.EOF)
+			}
+			b, _ := mr.inp.next(n + 1)
+			return mr.string(b[:n]), nil
+		}
 		buff := make([]byte, 0)
 		for c != 0x00 {
 			buff = append(buff, c)
-			c, err = mr.inp.ReadByte()
+			c, err = mr.readByte(tag)
 			if err != nil {
-				panic(err)
+				return "", err
 			}
-			// log.Printf("next char: %x", c)
 		}
-		res = string(buff)
-		return
+		return string(buff), nil
 	}
 }
 
-func (mr *muReader) readSpecial() any {
-	data := make([]byte, 1)
-	_, err := mr.inp.Read(data)
+func (mr *muReader) readSpecial() (any, error) {
+	t, err := mr.readByte(0)
 	if err != nil {
-		panic(err) // TODO: err handling
+		return nil, err
 	}
-	switch t := data[0]; t {
+	switch t {
 	case 0xAA:
-		return false
+		return false, nil
 	case 0xAB:
-		return true
+		return true, nil
 	case 0xAC:
-		return nil
-	case 0xAD:
-		// return math.NaN() // NOTE: NaN not valid JSON! replacing with nil
-		return nil
-	case 0xAE:
-		// return math.Inf(-1) // NOTE: Invalid JSON! replacing with nil
-		return nil
-	case 0xAF:
-		// return math.Inf(1) // NOTE: Invalid JSON: replacing with nil
-		return nil
+		return nil, nil
+	case 0xAD, 0xAE, 0xAF:
+		switch {
+		case mr.opts.nonFiniteAsNull:
+			return nil, nil
+		case t == 0xAD:
+			return math.NaN(), nil
+		case t == 0xAE:
+			return math.Inf(-1), nil
+		}
+		return math.Inf(1), nil
 	case 0xA0, 0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6, 0xA7, 0xA8, 0xA9:
-		return t - 0xA0
+		return t - 0xA0, nil
 	default:
-		panic("Wrong special value!")
+		return nil, mr.syntaxError(t, ErrUnknownTag, "wrong special value")
 	}
 }
 
-func (mr *muReader) readTypedValue() any {
-	data := make([]byte, 1)
-	_, err := mr.inp.Read(data)
+func (mr *muReader) readTypedValue() (any, error) {
+	t, err := mr.readByte(0)
 	if err != nil {
-		panic(err) // TODO: err handling
+		return nil, err
 	}
-	switch t := data[0]; t {
+	switch t {
 	case 0xB0:
-		res, err := mr.inp.ReadByte()
+		res, err := mr.readByte(t)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return int8(res)
+		return int8(res), nil
 	case 0xB1:
-		data := make([]byte, 2)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 2)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return int16(binary.LittleEndian.Uint16(data))
+		return int16(binary.LittleEndian.Uint16(data)), nil
 	case 0xB2:
-		data := make([]byte, 4)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 4)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return int32(binary.LittleEndian.Uint32(data))
+		return int32(binary.LittleEndian.Uint32(data)), nil
 	case 0xB3:
-		data := make([]byte, 8)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 8)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return int64(binary.LittleEndian.Uint64(data))
+		return int64(binary.LittleEndian.Uint64(data)), nil
 	case 0xB4:
-		res, err := mr.inp.ReadByte()
+		res, err := mr.readByte(t)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return uint8(res)
+		return uint8(res), nil
 	case 0xB5:
-		data := make([]byte, 2)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 2)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return binary.LittleEndian.Uint16(data)
+		return binary.LittleEndian.Uint16(data), nil
 	case 0xB6:
-		data := make([]byte, 4)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 4)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return binary.LittleEndian.Uint32(data)
+		return binary.LittleEndian.Uint32(data), nil
 	case 0xB7:
-		data := make([]byte, 8)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 8)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return (binary.LittleEndian.Uint64(data))
+		return binary.LittleEndian.Uint64(data), nil
 	case 0xB8:
-		log.Print("Handling f16!")
-		data := make([]byte, 2)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 2)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		f16 := myF16(float16.Frombits(binary.LittleEndian.Uint16(data)))
-		// log.Printf("float 16:%s", f16.String())
-		return f16
+		return Float16FromBits(binary.LittleEndian.Uint16(data)), nil
 	case 0xB9:
-		data := make([]byte, 4)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 4)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return math.Float32frombits(binary.LittleEndian.Uint32(data))
+		return math.Float32frombits(binary.LittleEndian.Uint32(data)), nil
 	case 0xBA:
-		data := make([]byte, 8)
-		_, err := mr.inp.Read(data)
+		data, err := mr.readFull(t, 8)
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, err
 		}
-		return math.Float64frombits(binary.LittleEndian.Uint64(data))
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
 	case 0xBB: // big ints; leb128
-		// TODO: string
-		return sleb128read(mr.inp).String()
+		n, err := mr.readSleb(t)
+		if err != nil {
+			return nil, err
+		}
+		if mr.opts.nativeInts {
+			switch {
+			case n.IsInt64():
+				return n.Int64(), nil
+			case n.IsUint64():
+				return n.Uint64(), nil
+			}
+		}
+		return n, nil
 	default:
-		panic("Unknown typed value")
+		return nil, mr.syntaxError(t, ErrUnknownTag, "unknown typed value")
 	}
 }
 
-func (mr *muReader) readTypedArray() any {
-	data, err := mr.inp.ReadByte()
+// readArrayHeader reads the tag and element type of a typed array.
+func (mr *muReader) readArrayHeader() (t byte, chunked bool, err error) {
+	tag, err := mr.readByte(0)
 	if err != nil {
-		panic(err) // TODO: err handling
-	}
-
-	var chunked bool
-	if data == 0x85 {
-		chunked = true
+		return 0, false, err
 	}
-
-	t, err := mr.inp.ReadByte()
+	t, err = mr.readByte(tag)
 	if err != nil {
-		panic(err) // TODO: err handling
+		return 0, false, err
+	}
+	if t != 0xBB && getTypeWidth(t) == 0 {
+		return 0, false, mr.syntaxError(t, ErrUnknownTag, "no typed array for type")
 	}
+	return t, tag == 0x85, nil
+}
 
-	var res []any
+// readArrayChunk reads n elements of type t into a slice of the matching Go
+// type. LEB128 elements come back as []int64, or as []*big.Int when one of
+// them doesn't fit.
+func (mr *muReader) readArrayChunk(t byte, n int) (any, error) {
 	switch t {
 	case 0xBB:
-		for {
-			n := uleb128read(mr.inp)
-			if n == 0 {
-				break
-			}
-
-			for i := 0; i < n; i++ {
-				val := sleb128read(mr.inp).String()
-				res = append(res, val)
-			}
-			if !chunked {
-				return res
+		res := make([]*big.Int, 0)
+		for i := 0; i < n; i++ {
+			val, err := mr.readSleb(t)
+			if err != nil {
+				return nil, err
 			}
+			res = append(res, val)
 		}
-	case 0xB8:
-		// TODO: support f16
-		log.Print("Handling f16!")
-		for {
-			n := uleb128read(mr.inp)
-			if n == 0 {
-				break
+		return varIntSlice(res), nil
+	default:
+		width := getTypeWidth(t)
+		if n > math.MaxInt/width {
+			return nil, mr.syntaxError(t, nil, "typed array too long")
+		}
+		bits, err := mr.readFull(t, n*width)
+		if err != nil {
+			return nil, err
+		}
+		if mr.borrow {
+			if arr, ok := borrowArray(t, bits); ok {
+				return arr, nil
 			}
+		}
+		return decodeArray(t, bits), nil
+	}
+}
 
-			for i := 0; i < n; i++ {
-				data := make([]byte, 2)
-				_, err := mr.inp.Read(data)
-				if err != nil {
-					panic(err)
-				}
-
-				f16 := myF16(float16.Frombits(binary.LittleEndian.Uint16(data)))
-				// fmt.Printf("%v\n", f16)
-				res = append(res, f16)
-			}
-			if !chunked {
-				return res
-			}
+func varIntSlice(vals []*big.Int) any {
+	ints := make([]int64, len(vals))
+	for i, v := range vals {
+		if !v.IsInt64() {
+			return vals
 		}
-	default:
-		for {
-			n := uleb128read(mr.inp)
-			if n == 0 {
-				break
-			}
+		ints[i] = v.Int64()
+	}
+	return ints
+}
 
-			bits := make([]byte, n*getTypeWidth(t))
-			_, err := mr.inp.Read(bits)
-			if err != nil {
-				panic(err) // TODO: err handling
-			}
-			// fmt.Printf("%x\n", bits)
-			// TODO: handle big endian
-			chunk := readArrayFromBits(t, bits)
-			if !chunked {
-				return chunk
-			}
+// AppendArrayChunk appends chunk, the Value of a TypedArrayChunk token, to
+// arr, which holds the earlier chunks of the same typed array, or is nil for
+// the first chunk. Appending every chunk of an array assembles it as Decode
+// returns it: LEB128 integers are a []int64, or a []*big.Int if any of them
+// doesn't fit in an int64.
+func AppendArrayChunk(arr, chunk any) any {
+	if arr == nil {
+		return chunk
+	}
+	a, c := reflect.ValueOf(arr), reflect.ValueOf(chunk)
+	if a.Type() != c.Type() {
+		// LEB128 chunks differ when only some of them fit in an int64.
+		return varIntSlice(append(bigInts(arr), bigInts(chunk)...))
+	}
+	return reflect.AppendSlice(a, c).Interface()
+}
 
-			sliced := chunk.([]any)
-			for _, v := range sliced {
-				res = append(res, v)
-			}
+// bigInts converts a slice returned by varIntSlice back to big ints.
+func bigInts(s any) []*big.Int {
+	if s, ok := s.([]int64); ok {
+		res := make([]*big.Int, len(s))
+		for i, v := range s {
+			res[i] = big.NewInt(v)
 		}
+		return res
 	}
-	return res
+	return s.([]*big.Int)
 }
 
-func (mr *muReader) readList() []any {
-	res := make([]any, 0)
-	b, err := mr.inp.ReadByte()
+func (mr *muReader) readTypedArray() (any, error) {
+	t, chunked, err := mr.readArrayHeader()
 	if err != nil {
-		panic(err) // TODO: err handling
+		return nil, err
 	}
-	if b != 0x90 {
-		panic("not a list start!") //TODO: err handling
+
+	var res any
+	for {
+		n, err := mr.readUleb(t)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && chunked {
+			break
+		}
+		chunk, err := mr.readArrayChunk(t, n)
+		if err != nil {
+			return nil, err
+		}
+		if !chunked {
+			return chunk, nil
+		}
+		res = AppendArrayChunk(res, chunk)
 	}
-	next, err := mr.inp.Peek(1)
-	if err != nil {
-		panic(err) // TODO: err handling
+	if res == nil { // chunked array without elements
+		return mr.readArrayChunk(t, 0)
 	}
-	for next[0] != 0x91 {
-		res = append(res, mr.ReadObject())
-		next, err = mr.inp.Peek(1)
-		if err != nil {
-			panic(err) // TODO: err handling
+	return res, nil
+}
+
+// skipArrayChunk reads past n elements of type t.
+func (mr *muReader) skipArrayChunk(t byte, n int) error {
+	if t == 0xBB {
+		for i := 0; i < n; i++ {
+			if _, err := mr.readSleb(t); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	_, err = mr.inp.ReadByte()
-	if err != nil {
-		panic(err) // TODO: err handling
+	width := getTypeWidth(t)
+	if n > math.MaxInt/width {
+		return mr.syntaxError(t, nil, "typed array too long")
+	}
+	if _, err := mr.inp.Discard(n * width); err != nil {
+		return mr.wrapErr(t, err)
 	}
-	return res
+	return nil
 }
 
-func (mr *muReader) readDict() map[string]any {
-	res := make(map[string]any)
-	b, err := mr.inp.ReadByte()
+// skipTypedArray reads past a typed array without decoding its elements.
+func (mr *muReader) skipTypedArray() error {
+	t, chunked, err := mr.readArrayHeader()
 	if err != nil {
-		panic(err) // TODO: err handling
+		return err
 	}
-	if b != 0x92 {
-		panic("not a dict start!") //TODO: err handling
+	for {
+		n, err := mr.readUleb(t)
+		if err != nil {
+			return err
+		}
+		if n == 0 && chunked {
+			return nil
+		}
+		if err := mr.skipArrayChunk(t, n); err != nil {
+			return err
+		}
+		if !chunked {
+			return nil
+		}
 	}
+}
 
-	next, err := mr.inp.Peek(1)
+func (mr *muReader) readList() ([]any, error) {
+	res := make([]any, 0, mr.prealloc())
+	b, err := mr.readByte(0)
 	if err != nil {
-		panic(err) // TODO: err handling
+		return nil, err
 	}
-	for next[0] != 0x93 {
-		key, ok := mr.ReadObject().(string)
-		if !ok {
-			panic(err)
+	if b != 0x90 {
+		return nil, mr.syntaxError(b, nil, "not a list start")
+	}
+	for {
+		next, err := mr.peekByte()
+		if err != nil {
+			return nil, mr.wrapErr(b, err)
+		}
+		if next == 0x91 {
+			break
 		}
-		val := mr.ReadObject()
-		res[key] = val
-		// log.Printf("key: %s  val: %v", key, val)
-		next, err = mr.inp.Peek(1)
+		val, err := mr.readObject()
 		if err != nil {
-			panic(err) // TODO: err handling
+			return nil, mr.wrapErr(b, err)
 		}
+		res = append(res, val)
 	}
-	_, err = mr.inp.ReadByte()
-	if err != nil {
-		panic(err) // TODO: err handling
+	if _, err := mr.readByte(b); err != nil {
+		return nil, err
 	}
-	return res
+	return res, nil
 }
 
-func (mr *muReader) ReadObject() any {
-	data, err := mr.inp.Peek(1)
-	var nxt byte
-	if err == nil {
-		nxt = data[0]
-	} else if err == io.EOF {
-		fmt.Printf("NO PEEK: %s\n", err)
-	} else if err != nil {
-		panic(err) // TODO: err handling
+// readDict reads a dict into a map[string]any, or into a map[any]any if any
+// of its keys isn't a string, or into an OrderedMap if the reader has
+// orderedMaps set. Dicts with keys that can't be map keys, such as lists,
+// can only be read as OrderedMaps; for other dicts they are an
+// *UnmarshalTypeError, returned once the whole dict has been read.
+func (mr *muReader) readDict() (any, error) {
+	if mr.opts.orderedMaps {
+		res := make(OrderedMap, 0, mr.prealloc())
+		err := mr.readDictEntries(func(key, val any, _ int64) {
+			res = append(res, KeyValue{Key: key, Value: val})
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
 	}
+	res := make(map[string]any, mr.prealloc())
+	var (
+		anyRes map[any]any
+		keyErr error
+	)
+	err := mr.readDictEntries(func(key, val any, off int64) {
+		if s, ok := key.(string); ok && anyRes == nil {
+			res[s] = val
+			return
+		}
+		k, ok := mapKey(key)
+		if !ok {
+			if keyErr == nil {
+				keyErr = &UnmarshalTypeError{
+					Value:  fmt.Sprintf("dict key of type %T", key),
+					Type:   reflect.TypeOf(anyRes),
+					Offset: off,
+				}
+			}
+			return
+		}
+		if anyRes == nil {
+			anyRes = make(map[any]any, len(res)+1)
+			for s, v := range res {
+				anyRes[s] = v
+			}
+		}
+		anyRes[k] = val
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case keyErr != nil:
+		return nil, keyErr
+	case anyRes != nil:
+		return anyRes, nil
+	}
+	return res, nil
+}
 
-	for nxt == 0xFF {
-		if _, err := mr.inp.ReadByte(); err != nil {
-			panic(err)
+// mapKey returns the dict key k as a map key. Integers read as *big.Int
+// become int64 or uint64, so that they compare by value. It reports false
+// for keys that can't be map keys.
+func mapKey(k any) (any, bool) {
+	switch k := k.(type) {
+	case nil:
+		return nil, true
+	case *big.Int:
+		switch {
+		case k.IsInt64():
+			return k.Int64(), true
+		case k.IsUint64():
+			return k.Uint64(), true
+		}
+		return nil, false
+	}
+	return k, reflect.TypeOf(k).Comparable()
+}
+
+// readDictEntries reads a dict and calls add for each of its entries, in
+// order, with the offset of the key.
+func (mr *muReader) readDictEntries(add func(key, val any, off int64)) error {
+	b, err := mr.readByte(0)
+	if err != nil {
+		return err
+	}
+	if b != 0x92 {
+		return mr.syntaxError(b, nil, "not a dict start")
+	}
+
+	for {
+		next, err := mr.peekByte()
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+		if next == 0x93 {
+			break
+		}
+		off := mr.inp.off
+		key, err := mr.readObject()
+		if err != nil {
+			return mr.wrapErr(b, err)
 		}
-		data, err = mr.inp.Peek(1)
+		val, err := mr.readObject()
 		if err != nil {
-			panic(err) // TODO: err handling
+			return mr.wrapErr(b, err)
 		}
-		nxt = data[0]
+		add(key, val, off)
 	}
+	_, err = mr.readByte(b)
+	return err
+}
 
-	if nxt > 0x82 && nxt <= 0xC1 {
-		switch {
-		case nxt >= 0xA0 && nxt <= 0xAF:
-			return mr.readSpecial()
-		case nxt >= 0xB0 && nxt <= 0xBB:
-			return mr.readTypedValue()
-		case nxt == 0x84 || nxt == 0x85:
-			return mr.readTypedArray()
-		case nxt == 0x8A:
-			_, err := mr.inp.ReadByte()
+// ReadObject reads the next value from the input. It returns io.EOF if the
+// input ends before a value starts, and a *SyntaxError if the input is
+// malformed or ends in the middle of a value.
+func (mr *muReader) ReadObject() (any, error) {
+	return mr.readObject()
+}
+
+// nextTag consumes the padding, magic, count and size tags and LRU lists in
+// front of the next value and returns the tag byte that starts the value,
+// without consuming it. It returns io.EOF if the input ends before a value
+// starts.
+func (mr *muReader) nextTag() (byte, error) {
+	// tag is set once a count or size tag has been read, after which running
+	// out of input is no longer a clean EOF.
+	var tag byte
+	for {
+		nxt, err := mr.peekByte()
+		if err == io.EOF && tag == 0 {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, mr.wrapErr(tag, err)
+		}
+
+		switch nxt {
+		case 0xFF: // padding
+			if _, err := mr.inp.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x8A, 0x8B: // count and size tags
+			if mr.tags.off != mr.inp.off {
+				mr.tags = valueTags{count: -1, size: -1}
+			}
+			if _, err := mr.inp.ReadByte(); err != nil {
+				return 0, err
+			}
+			n, err := mr.readUleb(nxt)
 			if err != nil {
-				panic(err) // TODO: err handling
+				return 0, err
+			}
+			if nxt == 0x8A {
+				mr.tags.count = n
+			} else {
+				mr.tags.size = n
 			}
-			_ = uleb128read(mr.inp)
-			return mr.ReadObject()
-		case nxt == 0x8B:
-			_, err := mr.inp.ReadByte()
+			mr.tags.off = mr.inp.off
+			tag = nxt
+		case 0x8C:
+			b, err := mr.inp.Peek(2)
+			if len(b) < 2 {
+				return 0, mr.wrapErr(nxt, err)
+			}
+			if err := mr.checkDict(nxt); err != nil {
+				return 0, err
+			}
+			if b[1] != 0x90 { // a string that is added to the LRU
+				return nxt, nil
+			}
+			if _, err := mr.inp.ReadByte(); err != nil {
+				return 0, err
+			}
+			list, err := mr.readList()
 			if err != nil {
-				panic(err) // TODO: err handling
+				return 0, err
+			}
+			// Read next object (LRU list is skipped)
+			mr.lru.Extend(list)
+		case 0x8D: // shared dictionary
+			if _, err := mr.inp.ReadByte(); err != nil {
+				return 0, err
+			}
+			id, err := uleb128readUint(mr.inp)
+			if err == errLEB128Overflow {
+				return 0, mr.syntaxError(nxt, nil, err.Error())
 			}
-			_ = uleb128read(mr.inp)
-			return mr.ReadObject()
-		case nxt == 0x8C:
-			_, err := mr.inp.ReadByte()
 			if err != nil {
-				panic(err) // TODO: err handling
+				return 0, mr.wrapErr(nxt, err)
 			}
-			if mr.peekByte() == 0x90 {
-				mr.lru.Extend(mr.readList())
-				// Read next object (LRU list is skipped)
-				return mr.ReadObject()
-			} else {
-				res := mr.readString()
-				mr.lru.Append(res)
-				return res
+			if d := mr.opts.shared; d == nil || id != uint64(d.ID) {
+				return 0, mr.syntaxError(nxt, ErrDictionaryMismatch, fmt.Sprintf("stream needs dictionary %08x", id))
 			}
-		case nxt == 0x8F:
-			data := make([]byte, 4)
-			_, err := mr.inp.Read(data)
+			mr.dictSeen = true
+		case 0x8F:
+			data, err := mr.readFull(nxt, 4)
 			if err != nil {
-				panic(err) // TODO: err handling
+				return 0, err
 			}
 			if !bytes.Equal([]byte(MuonMagic), data) {
-				panic("not muon magic!")
+				return 0, mr.syntaxError(nxt, nil, "not muon magic")
 			}
-			return mr.ReadObject()
-		case nxt == 0x90:
-			return mr.readList()
-		case nxt == 0x92:
-			return mr.readDict()
 		default:
-			panic("Unknown object")
+			if err := mr.checkDict(nxt); err != nil {
+				return 0, err
+			}
+			return nxt, nil
+		}
+	}
+}
+
+// valueTags are the count and size tags in front of a value.
+type valueTags struct {
+	off   int64 // offset of the value
+	count int   // -1 if there is no count tag
+	size  int   // -1 if there is no size tag
+}
+
+// valueTags returns the count and size tags of the value at the current
+// offset, as read by nextTag, or -1 for those it doesn't have.
+func (mr *muReader) valueTags() (count, size int) {
+	if mr.tags.off != mr.inp.off {
+		return -1, -1
+	}
+	return mr.tags.count, mr.tags.size
+}
+
+// maxPrealloc limits the room made for elements on the word of a count tag,
+// which may be wrong.
+const maxPrealloc = 1 << 16
+
+// prealloc returns the number of elements to make room for in the list or
+// dict at the current offset.
+func (mr *muReader) prealloc() int {
+	n, _ := mr.valueTags()
+	switch {
+	case n < 0:
+		return 0
+	case n > maxPrealloc:
+		return maxPrealloc
+	}
+	return n
+}
+
+// checkDict reports a stream that doesn't start by naming the shared
+// dictionary the reader was given.
+func (mr *muReader) checkDict(tag byte) error {
+	if mr.opts.shared != nil && !mr.dictSeen {
+		return mr.syntaxError(tag, ErrDictionaryMismatch, "stream names no dictionary")
+	}
+	return nil
+}
+
+func (mr *muReader) readObject() (any, error) {
+	nxt, err := mr.nextTag()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case nxt <= 0x82 || nxt > 0xC1:
+		return mr.readString()
+	case nxt >= 0xA0 && nxt <= 0xAF:
+		return mr.readSpecial()
+	case nxt >= 0xB0 && nxt <= 0xBB:
+		return mr.readTypedValue()
+	case nxt == 0x84 || nxt == 0x85:
+		return mr.readTypedArray()
+	case nxt == 0x8C:
+		if _, err := mr.inp.ReadByte(); err != nil {
+			return nil, err
+		}
+		res, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		mr.lru.Append(res)
+		return res, nil
+	case nxt == 0x90:
+		return mr.readList()
+	case nxt == 0x92:
+		return mr.readDict()
+	default:
+		return nil, mr.syntaxError(nxt, ErrUnknownTag, "unknown object")
+	}
+}
+
+// skip reads past the next value without building it. Only strings tagged
+// for the LRU are decoded, since later references depend on them.
+func (mr *muReader) skip() error {
+	var open []byte // tags of the lists and dicts being skipped
+	for {
+		tag, err := mr.nextTag()
+		if _, size := mr.valueTags(); err == nil && size >= 0 && mr.canJump(tag) {
+			if _, err = mr.inp.Discard(size); err != nil {
+				err = mr.wrapErr(tag, err)
+			}
+		} else if err == nil {
+			switch {
+			case tag == 0x90 || tag == 0x92:
+				_, err = mr.inp.ReadByte()
+				open = append(open, tag)
+			case tag == 0x91 || tag == 0x93:
+				if len(open) == 0 || open[len(open)-1] != tag-1 {
+					return mr.syntaxError(tag, nil, "unexpected end of list or dict")
+				}
+				_, err = mr.inp.ReadByte()
+				open = open[:len(open)-1]
+			case tag == 0x84 || tag == 0x85:
+				err = mr.skipTypedArray()
+			case tag <= 0x82 || tag > 0xC1:
+				err = mr.skipString()
+			default:
+				_, err = mr.readObject()
+			}
+		}
+		if err != nil {
+			if len(open) > 0 {
+				return mr.wrapErr(open[len(open)-1], err)
+			}
+			return err
+		}
+		if len(open) == 0 {
+			return nil
 		}
 	}
-	return mr.readString()
+}
+
+// canJump reports whether skip can jump over a value with a size tag that
+// starts with tag. Lists and dicts can hold strings added to the LRU, which
+// later references need, so the reader only jumps over them if it has the
+// sizeTags option, promising that the stream comes from a writer that
+// doesn't add strings to the LRU inside them, as this package's doesn't.
+func (mr *muReader) canJump(tag byte) bool {
+	if tag == 0x90 || tag == 0x92 {
+		return mr.opts.sizeTags
+	}
+	return tag != 0x8C
+}
+
+func (mr *muReader) skipString() error {
+	c, err := mr.readByte(0)
+	if err != nil {
+		return err
+	}
+	switch c {
+	case 0x81:
+		_, err = mr.readUleb(c)
+		return err
+	case 0x82:
+		n, err := mr.readUleb(c)
+		if err != nil {
+			return err
+		}
+		if _, err := mr.inp.Discard(n); err != nil {
+			return mr.wrapErr(c, err)
+		}
+		return nil
+	default:
+		tag := c
+		for c != 0x00 {
+			if c, err = mr.readByte(tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
 // func dumps(data)
@@ -961,14 +1776,3 @@ func (mr *muReader) ReadObject() any {
 // 	log.Printf("%v bytes written to %s", n, outf.Name())
 
 // }
-
-type myF16 float16.Float16
-
-func (f16 myF16) MarshalJSON() ([]byte, error) {
-	realF16 := float16.Float16(f16)
-	f16JSON, err := json.Marshal(realF16.Float32())
-	if err != nil {
-		panic(err)
-	}
-	return f16JSON, nil
-}
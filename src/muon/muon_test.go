@@ -3,10 +3,18 @@ package muon
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -117,7 +125,10 @@ func TestUleb128Read(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := uleb128read(tc.input)
+			got, err := uleb128read(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
 			diff := cmp.Diff(got, tc.want)
 			if diff != "" {
 				t.Fatalf(diff)
@@ -154,19 +165,50 @@ func TestLRU(t *testing.T) {
 				"string5",
 			},
 		},
+		{
+			name: "remove",
+			cap:  4,
+			ops: []lruOp{
+				{"add", "a"},
+				{"add", "b"},
+				{"add", "c"},
+				{"remove", "b"},
+				{"add", "d"},
+				{"add", "e"},
+				{"add", "f"},
+				{"remove", "f"},
+			},
+			want: []string{"c", "d", "e"},
+		},
+		{
+			name: "duplicates",
+			cap:  3,
+			ops: []lruOp{
+				{"add", "a"},
+				{"add", "b"},
+				{"add", "a"},
+				{"remove", "a"},
+				{"add", "c"},
+				{"add", "d"},
+			},
+			want: []string{"b", "c", "d"},
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			lru := NewLRU(tc.cap)
 			for _, op := range tc.ops {
-				if op.op == "add" {
+				switch op.op {
+				case "add":
 					lru.Append(op.val)
+				case "remove":
+					lru.Remove(op.val)
 				}
 			}
 			got := make([]string, 0)
-			for _, v := range lru.deque {
-				got = append(got, v.(string))
+			for i := lru.Len() - 1; i >= 0; i-- {
+				got = append(got, lru.Get(-i).(string))
 			}
 			if diff := cmp.Diff(tc.want, got); diff != "" {
 				t.Errorf(diff)
@@ -175,6 +217,553 @@ func TestLRU(t *testing.T) {
 	}
 }
 
+func TestLRUNaN(t *testing.T) {
+	lru := NewLRU(4)
+	for i := 0; i < 100; i++ {
+		lru.Append(math.NaN())
+		lru.Append(float32(math.NaN()))
+	}
+	if len(lru.index) != 0 {
+		t.Errorf("got %d values in the index, want none", len(lru.index))
+	}
+	if lru.Len() != 4 || lru.FindIndex(math.NaN()) != -1 {
+		t.Errorf("got length %d and index %d, want 4 and -1", lru.Len(), lru.FindIndex(math.NaN()))
+	}
+}
+
+func TestLRUOptions(t *testing.T) {
+	doc := []any{"alpha", "beta", "alpha", "beta", "alpha"}
+	dict := WithDictionary([]string{"alpha", "beta"})
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"dictionary", []Option{dict}, "\x90\x8Calpha\x00\x8Cbeta\x00\x81\x01\x81\x00\x81\x01\x91"},
+		{"small LRU", []Option{dict, WithLRUSize(1)}, "\x90\x8Calpha\x00\x8Cbeta\x00alpha\x00\x81\x00alpha\x00\x91"},
+		{"small dynamic LRU", []Option{dict, WithDynamicLRUSize(1)}, "\x90\x8Calpha\x00beta\x00\x81\x00beta\x00\x81\x00\x91"},
+		{"no LRU", []Option{dict, WithoutLRU()}, "\x90alpha\x00beta\x00alpha\x00beta\x00alpha\x00\x91"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Marshal(doc, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, string(b)); diff != "" {
+				t.Error(diff)
+			}
+			var got []any
+			if err := Unmarshal(b, &got, tc.opts...); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(doc, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	b, _ := Marshal(doc, dict)
+	for _, opt := range []Option{WithLRUSize(1), WithoutLRU()} {
+		var got []any
+		err := Unmarshal(b, &got, opt)
+		var synErr *SyntaxError
+		if !errors.As(err, &synErr) || !strings.Contains(err.Error(), "beyond the reader's LRU size") {
+			t.Errorf("got error %v, want a *SyntaxError for the reference beyond the LRU", err)
+		}
+	}
+}
+
+func TestSizeAndCountTags(t *testing.T) {
+	tagged := []Option{WithSizeTags(), WithCountTags()}
+	b, err := Marshal([]any{[]int8{1, -1}, []any{1, 2}, "x"}, tagged...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x8A, 0x03, 0x8B, 0x11, 0x90,
+		0x84, 0xB0, 0x02, 0x01, 0xFF, // typed arrays don't get tags
+		0x8A, 0x02, 0x8B, 0x04, 0x90, 0xA1, 0xA2, 0x91,
+		'x', 0x00, 0x91}
+	if diff := cmp.Diff(want, b); diff != "" {
+		t.Error(diff)
+	}
+
+	long := strings.Repeat("s", 70)
+	in := map[string]any{"list": []any{"a", long}, "n": uint8(1), "m": map[string]any{}}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, append(tagged, WithDictionary([]string{"list"}))...)
+	e.BeginDict()
+	e.Key("list")
+	e.Encode(in["list"])
+	e.Key("n")
+	e.Int(1)
+	e.Key("m")
+	e.Encode(in["m"])
+	if err := e.EndDict(); err != nil {
+		t.Fatal(err)
+	}
+	b = buf.Bytes()
+	if !bytes.HasPrefix(b, []byte{0x8A, 0x03}) {
+		t.Errorf("got % x, want a count of 3 entries first", b)
+	}
+	if !bytes.Contains(b, append([]byte{0x8B, 71}, long...)) {
+		t.Errorf("got % x, want a size tag on the long string", b)
+	}
+	if bytes.IndexByte(b, 0x8C) >= 0 {
+		t.Errorf("got % x, want no strings added to the LRU with size tags", b)
+	}
+	var got any
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(in, got); diff != "" {
+		t.Error(diff)
+	}
+
+	// the ID of a shared dictionary comes before the tags
+	b, _ = Marshal([]any{}, WithSizeTags(), WithSharedDictionary(NewDictionary(nil)))
+	if len(b) == 0 || b[0] != 0x8D {
+		t.Errorf("got % x, want the dictionary ID first", b)
+	}
+
+	// counts make room for the elements, but only so much
+	var ints []int
+	if err := Unmarshal([]byte{0x8A, 0x03, 0x90, 0xA1, 0x91}, &ints); err != nil || cap(ints) != 3 {
+		t.Errorf("got %v with capacity %d, %v, want capacity 3", ints, cap(ints), err)
+	}
+	ints = nil
+	if err := Unmarshal([]byte{0x8A, 0x80, 0x94, 0xEB, 0xDC, 0x03, 0x90, 0xA1, 0x91}, &ints); err != nil || cap(ints) > maxPrealloc {
+		t.Errorf("got capacity %d, %v for a count of 1e9, want at most %d", cap(ints), err, maxPrealloc)
+	}
+}
+
+func TestSkipSized(t *testing.T) {
+	// the sized value is not valid MuON, so skipping it proves it is not read
+	doc := []byte{0x90, 0x8B, 0x03, 0x86, 0x86, 0x86, 0xA5, 0x91}
+	d := NewDecoder(bytes.NewReader(doc))
+	if tok, err := d.Token(); err != nil || tok.Kind != ListStart {
+		t.Fatalf("got %v, %v, want ListStart", tok, err)
+	}
+	if err := d.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := d.Token(); err != nil || tok.Value != uint8(5) {
+		t.Errorf("got %v, %v after skipping, want 5", tok, err)
+	}
+
+	d = NewDecoder(bytes.NewReader([]byte{0x8B, 0x05, 0x90, 0x91}), WithSizeTags())
+	if err := d.Skip(); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("got error %v for a size past the end, want ErrUnexpectedEOF", err)
+	}
+}
+
+// TestSkipSizedLRU checks that skipping a dict with a size tag still reads
+// the strings added to the LRU in it, which writers other than this
+// package's may put there, unless the reader has WithSizeTags.
+func TestSkipSizedLRU(t *testing.T) {
+	doc := []byte{
+		0x90,
+		0x8B, 0x0A, 0x92, 'k', 0x00, 0x8C, 'v', 'a', 'l', 0x00, 0xA1, 0x93,
+		0x81, 0x00,
+		0x91,
+	}
+	d := NewDecoder(bytes.NewReader(doc))
+	if tok, err := d.Token(); err != nil || tok.Kind != ListStart {
+		t.Fatalf("got %v, %v, want ListStart", tok, err)
+	}
+	if err := d.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := d.Token(); err != nil || tok.Value != "val" {
+		t.Errorf("got %v, %v after skipping, want val", tok, err)
+	}
+
+	// readers with the option trust the writer and jump over the dict, so
+	// the reference after it is to nothing
+	d = NewDecoder(bytes.NewReader(doc), WithSizeTags())
+	d.Token()
+	if err := d.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := d.Token(); err == nil {
+		t.Errorf("got %v after jumping, want an error", tok)
+	}
+}
+
+// stringsDoc returns a list of n strings drawn from a vocabulary of 2000,
+// like the keys and enum values of a large document.
+func stringsDoc(n int) []any {
+	doc := make([]any, n)
+	for i := range doc {
+		doc[i] = fmt.Sprintf("value-%d", (i*7919)%2000)
+	}
+	return doc
+}
+
+// sliceLRU is the LRU as it was before the ring buffer, with lookups that
+// scan every value, kept as a baseline for BenchmarkLRU.
+type sliceLRU struct {
+	cap   int
+	deque []any
+}
+
+func (lru *sliceLRU) Append(val any) {
+	if len(lru.deque) == lru.cap {
+		lru.deque = lru.deque[1:]
+	}
+	lru.deque = append(lru.deque, val)
+}
+
+func (lru *sliceLRU) FindIndex(val any) int {
+	for i, v := range lru.deque {
+		if cmp.Equal(v, val) {
+			return i
+		}
+	}
+	return -1
+}
+
+func BenchmarkLRU(b *testing.B) {
+	doc := stringsDoc(100000)
+	// the baseline takes most of a minute, so b.N stays at 1 for it
+	for _, bm := range []struct {
+		name string
+		lru  interface {
+			Append(any)
+			FindIndex(any) int
+		}
+	}{
+		{"FindIndex", NewLRU(512)},
+		{"FindIndexSlice", &sliceLRU{cap: 512}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, s := range doc {
+					if bm.lru.FindIndex(s) < 0 {
+						bm.lru.Append(s)
+					}
+				}
+			}
+		})
+	}
+	b.Run("Write", func(b *testing.B) {
+		d := NewDictBuilder()
+		d.Add(doc)
+		table := d.GetDict(512)
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			mw := NewMuWriter(&buf)
+			mw.AddLRUDynamic(table)
+			if err := mw.Add(doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.SetBytes(int64(buf.Len()))
+	})
+}
+
+func newBytesReader(b []byte) *muReader {
+	return NewMuReader(*bufio.NewReader(bytes.NewReader(b)))
+}
+
+func TestReadObjectErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []byte
+		wantErr    error // checked with errors.Is; nil means any *SyntaxError
+		wantTag    byte
+		wantOffset int64
+	}{
+		{name: "truncated string", input: []byte("abc"), wantErr: ErrUnexpectedEOF, wantTag: 'a', wantOffset: 3},
+		{name: "unterminated list", input: []byte{0x90, 0xA1}, wantErr: ErrUnexpectedEOF, wantTag: 0x90, wantOffset: 2},
+		{name: "unterminated dict", input: []byte{0x92, 'k', 0x00}, wantErr: ErrUnexpectedEOF, wantTag: 0x92, wantOffset: 3},
+		{name: "truncated u16", input: []byte{0xB5, 0x01}, wantErr: ErrUnexpectedEOF, wantTag: 0xB5, wantOffset: 2},
+		{name: "truncated sized string", input: []byte{0x82, 0x05, 'a'}, wantErr: ErrUnexpectedEOF, wantTag: 0x82, wantOffset: 3},
+		{name: "truncated typed array", input: []byte{0x84, 0xB4, 0x03, 0x01}, wantErr: ErrUnexpectedEOF, wantTag: 0xB4, wantOffset: 4},
+		{name: "count tag without value", input: []byte{0x8A, 0x01}, wantErr: ErrUnexpectedEOF, wantTag: 0x8A, wantOffset: 2},
+		{name: "unknown tag", input: []byte{0x83}, wantErr: ErrUnknownTag, wantTag: 0x83, wantOffset: 0},
+		{name: "unknown tag in list", input: []byte{0x90, 0xA1, 0x86, 0x91}, wantErr: ErrUnknownTag, wantTag: 0x86, wantOffset: 2},
+		{name: "unknown typed array", input: []byte{0x84, 0x00, 0x01}, wantErr: ErrUnknownTag, wantTag: 0x00, wantOffset: 2},
+		{name: "LRU index out of range", input: []byte{0x81, 0x00}, wantTag: 0x81, wantOffset: 2},
+		{name: "bad magic", input: []byte{0x8F, 0xB5, 0x30, 0x32}, wantTag: 0x8F, wantOffset: 4},
+		{name: "uleb128 overflow", input: []byte{0x82, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, wantTag: 0x82, wantOffset: 11},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// the same errors come from a reader of a []byte
+			borrowing := newMuReader(newDataReader(tc.input), newOptions([]Option{WithBorrowed()}))
+			for _, mr := range []*muReader{newBytesReader(tc.input), borrowing} {
+				_, err := mr.ReadObject()
+				var synErr *SyntaxError
+				if !errors.As(err, &synErr) {
+					t.Fatalf("got error %v, want a *SyntaxError", err)
+				}
+				if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+					t.Errorf("got error %v, want %v", err, tc.wantErr)
+				}
+				if synErr.Tag != tc.wantTag {
+					t.Errorf("got tag 0x%02X, want 0x%02X", synErr.Tag, tc.wantTag)
+				}
+				if synErr.Offset != tc.wantOffset {
+					t.Errorf("got offset %d, want %d", synErr.Offset, tc.wantOffset)
+				}
+			}
+		})
+	}
+}
+
+func TestReadObjectEOF(t *testing.T) {
+	for _, input := range [][]byte{{}, []byte(MuonMagic), {0xFF, 0xFF}} {
+		if _, err := newBytesReader(input).ReadObject(); err != io.EOF {
+			t.Errorf("input %x: got error %v, want io.EOF", input, err)
+		}
+	}
+
+	mr := newBytesReader([]byte{0x90, 0xA1, 0x91, 'x', 0x00})
+	for _, want := range []any{[]any{uint8(1)}, "x"} {
+		got, err := mr.ReadObject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Error(diff)
+		}
+	}
+	if _, err := mr.ReadObject(); err != io.EOF {
+		t.Errorf("got error %v after last value, want io.EOF", err)
+	}
+}
+
+// failingWriter accepts n bytes and then fails every write.
+type failingWriter struct {
+	n      int
+	writes int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	fw.writes++
+	if len(b) > fw.n {
+		n := fw.n
+		fw.n = 0
+		return n, errDiskFull
+	}
+	fw.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriterStickyError(t *testing.T) {
+	fw := &failingWriter{n: 3}
+	mw := NewMuWriter(fw)
+	err := mw.Add(map[string]any{"key": []any{"a", "b", "c"}})
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("got error %v, want %v", err, errDiskFull)
+	}
+	writes := fw.writes
+	if err := mw.Add("more"); !errors.Is(err, errDiskFull) {
+		t.Errorf("got error %v on later Add, want %v", err, errDiskFull)
+	}
+	if err := mw.TagMuon(); !errors.Is(err, errDiskFull) {
+		t.Errorf("got error %v on later TagMuon, want %v", err, errDiskFull)
+	}
+	if fw.writes != writes {
+		t.Errorf("writer was called %d more times after failing", fw.writes-writes)
+	}
+	if !errors.Is(mw.Err(), errDiskFull) {
+		t.Errorf("got Err() %v, want %v", mw.Err(), errDiskFull)
+	}
+}
+
+func TestWriterUnsupportedType(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      any
+		wantType string
+	}{
+		{"complex", complex(1, 2), "complex128"},
+		{"nested func", []any{1, func() {}}, "func()"},
+		{"channel", map[string]any{"c": make(chan int)}, "chan int"},
+		{"complex map key", map[complex64]string{1: "one"}, "complex64"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			mw := NewMuWriter(&buf)
+			err := mw.Add(tc.val)
+			if !errors.Is(err, ErrUnsupportedType) {
+				t.Fatalf("got error %v, want %v", err, ErrUnsupportedType)
+			}
+			if !strings.Contains(err.Error(), tc.wantType) {
+				t.Errorf("error %q doesn't name type %s", err, tc.wantType)
+			}
+			if err := mw.Add("ok"); !errors.Is(err, ErrUnsupportedType) {
+				t.Errorf("got error %v after unsupported value, want it to stick", err)
+			}
+		})
+	}
+}
+
+// TestIntEncodingReference checks the writer's integer encodings against
+// those of testdata/ints-py.txt, which testdata/ints.py writes with the
+// reference Python writer or its rules for integers; the first line of the
+// file says which.
+func TestIntEncodingReference(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "ints-py.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		dec, enc, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("bad line %q", line)
+		}
+		want, err := hex.DecodeString(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := NewMuWriter(&buf).Add(bigInt(dec)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: got % x, want % x", dec, buf.Bytes(), want)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	val := map[string]any{
+		"name":  "muon",
+		"tags":  []any{"a", "b", nil, true, false},
+		"small": 7,
+		"pi":    3.25,
+		"bytes": []byte{1, 2, 3},
+		"list":  []string{"x", "y"},
+	}
+	want := map[string]any{
+		"name":  "muon",
+		"tags":  []any{"a", "b", nil, true, false},
+		"small": uint8(7),
+		"pi":    3.25,
+		"bytes": []uint8{1, 2, 3},
+		"list":  []any{"x", "y"},
+	}
+
+	var buf bytes.Buffer
+	mw := NewMuWriter(&buf)
+	if err := mw.TagMuon(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Add(val); err != nil {
+		t.Fatal(err)
+	}
+	got, err := newBytesReader(buf.Bytes()).ReadObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func bigInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic(s)
+	}
+	return i
+}
+
+// TestIntEncoding checks the integer forms picked by the writer, which are
+// those of the reference Python writer: digits for 0 to 9, otherwise the
+// smallest fixed width type that holds the value, or LEB128 when that is
+// strictly shorter. The LEB128 bytes were computed with Python's integers,
+// not this package; TestIntEncodingReference checks the same boundaries
+// against testdata/ints-py.txt.
+func TestIntEncoding(t *testing.T) {
+	tests := []struct {
+		in   any
+		want []byte
+	}{
+		{0, []byte{0xA0}},
+		{9, []byte{0xA9}},
+		{10, []byte{0xB4, 0x0A}},
+		{64, []byte{0xB4, 0x40}},
+		{127, []byte{0xB4, 0x7F}},
+		{128, []byte{0xB4, 0x80}},
+		{255, []byte{0xB4, 0xFF}},
+		{256, []byte{0xB5, 0x00, 0x01}},
+		{1000, []byte{0xB5, 0xE8, 0x03}},
+		{65535, []byte{0xB5, 0xFF, 0xFF}},
+		{65536, []byte{0xBB, 0x80, 0x80, 0x04}},
+		{1 << 20, []byte{0xB6, 0x00, 0x00, 0x10, 0x00}},
+		{int64(math.MaxUint32), []byte{0xB6, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{int64(1 << 32), []byte{0xBB, 0x80, 0x80, 0x80, 0x80, 0x10}},
+		{int64(1 << 41), []byte{0xBB, 0x80, 0x80, 0x80, 0x80, 0x80, 0xC0, 0x00}},
+		{int64(1 << 48), []byte{0xB7, 0, 0, 0, 0, 0, 0, 0x01, 0}},
+		{int64(1<<55 - 1), []byte{0xB7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, 0}},
+		{int64(math.MaxInt64), []byte{0xB7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}},
+		{uint64(1 << 63), []byte{0xB7, 0, 0, 0, 0, 0, 0, 0, 0x80}},
+		{uint64(math.MaxUint64), []byte{0xB7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{-1, []byte{0xB0, 0xFF}},
+		{-128, []byte{0xB0, 0x80}},
+		{-129, []byte{0xB1, 0x7F, 0xFF}},
+		{-32768, []byte{0xB1, 0x00, 0x80}},
+		{-32769, []byte{0xBB, 0xFF, 0xFF, 0x7D}},
+		{-100000, []byte{0xBB, 0xE0, 0xF2, 0x79}},
+		{math.MinInt32, []byte{0xB2, 0x00, 0x00, 0x00, 0x80}},
+		{int64(math.MinInt32 - 1), []byte{0xBB, 0xFF, 0xFF, 0xFF, 0xFF, 0x77}},
+		{int64(-1 << 40), []byte{0xBB, 0x80, 0x80, 0x80, 0x80, 0x80, 0x60}},
+		{int64(math.MinInt64), []byte{0xB3, 0, 0, 0, 0, 0, 0, 0, 0x80}},
+		{int8(-5), []byte{0xB0, 0xFB}},
+		{int16(300), []byte{0xB5, 0x2C, 0x01}},
+		{int32(7), []byte{0xA7}},
+		{uint8(200), []byte{0xB4, 0xC8}},
+		{uint16(7), []byte{0xA7}},
+		{uint(1000), []byte{0xB5, 0xE8, 0x03}},
+		{big.NewInt(1000), []byte{0xB5, 0xE8, 0x03}},
+		{new(big.Int).SetUint64(math.MaxUint64), []byte{0xB7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{bigInt("18446744073709551616"), []byte{0xBB, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02}},
+		{bigInt("-18446744073709551617"), []byte{0xBB, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7D}},
+		{(*big.Int)(nil), []byte{0xAC}},
+	}
+
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := NewMuWriter(&buf).Add(tc.in); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tc.want, buf.Bytes()); diff != "" {
+			t.Errorf("%T %v: %s", tc.in, tc.in, diff)
+		}
+
+		if _, ok := tc.in.(*big.Int); !ok {
+			got := reflect.New(reflect.TypeOf(tc.in))
+			if err := Unmarshal(tc.want, got.Interface()); err != nil {
+				t.Fatalf("%T %v: %v", tc.in, tc.in, err)
+			}
+			if got.Elem().Interface() != tc.in {
+				t.Errorf("got %v back, want %T %v", got.Elem(), tc.in, tc.in)
+			}
+		}
+
+		b, err := Marshal(struct{ V any }{tc.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, tc.want) {
+			t.Errorf("Marshal of %T %v gave %X, want it to contain %X", tc.in, tc.in, b, tc.want)
+		}
+	}
+}
+
 // type jsonData struct {
 // 	X map[string]any `json:"-"`
 // }
@@ -257,12 +846,16 @@ func mu2Obj(file string) any {
 
 	m.inp.Reset(f)
 
-	return m.ReadObject()
+	obj, err := m.ReadObject()
+	if err != nil {
+		panic(err) // TODO: err handling
+	}
+	return obj
 }
 
 func Mu2JSON(file string) []byte {
 	obj := mu2Obj(file)
-	jsonData, err := json.Marshal(obj)
+	jsonData, err := ToJSON(obj, NonFiniteNull)
 	if err != nil {
 		panic(err) // TODO: err handling
 	}
@@ -284,6 +877,7 @@ func TestMu2JSON(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
+			skipIfMissing(t, tc.muSrcFile, tc.jsonWantFile)
 			wantJSONObj := cleanUnmarshalFile(tc.jsonWantFile)
 
 			// NOTE: should we marshal and unmarshal the json again for a better comparison?
@@ -303,6 +897,16 @@ func TestMu2JSON(t *testing.T) {
 	}
 }
 
+// skipIfMissing skips tests whose fixture files aren't available on this machine.
+func skipIfMissing(t *testing.T, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			t.Skipf("fixture not available: %s", f)
+		}
+	}
+}
+
 func cleanUnmarshalFile(jsonFile string) map[string]any {
 	jsonData, err := os.ReadFile(jsonFile)
 	if err != nil {
@@ -423,6 +1027,7 @@ func TestEqJSON(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
+			skipIfMissing(t, tc.file1, tc.file2)
 			got, diff, err := eqJSONFiles(tc.file1, tc.file2)
 			if err != nil {
 				log.Println(err)
@@ -435,3 +1040,64 @@ func TestEqJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestDictBuilder(t *testing.T) {
+	doc1 := map[string]any{"items": []any{"red", "green", "red", "green", "blue"}}
+	doc2 := []any{map[string]any{"items": "red"}, "x", "x", "x"}
+
+	d := NewDictBuilder()
+	d.Add(doc1)
+	d.Add(doc2)
+	// "x" saves nothing: its references are as long as the string
+	want := []string{"green", "items", "red"}
+	dict := d.GetDict(10)
+	if diff := cmp.Diff(want, dict); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff(want[:2], d.GetDict(2)); diff != "" {
+		t.Error(diff)
+	}
+
+	// the estimate is exact while indexes fit in a byte
+	var plain, small bytes.Buffer
+	for _, doc := range []any{doc1, doc2} {
+		if err := NewEncoder(&plain).Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewEncoder(&small, WithDictionary(dict))
+	for _, doc := range []any{doc1, doc2} {
+		if err := e.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := d.ExpectedSavings(dict), plain.Len()-small.Len(); got != want {
+		t.Errorf("got expected savings %d, want %d", got, want)
+	}
+
+	d.Reset()
+	if got := d.GetDict(10); len(got) != 0 {
+		t.Errorf("got %v after Reset, want nothing", got)
+	}
+
+	// strings that only pay off with one byte indexes stop at rank 128
+	for i := 0; i < 200; i++ {
+		s := fmt.Sprintf("%03d", i)
+		d.AddStr(s)
+		d.AddStr(s)
+	}
+	if got := d.GetDict(512); len(got) != 128 || got[0] != "000" || got[127] != "127" {
+		t.Errorf("got %d strings from %v to %v, want 128 from 000", len(got), got[0], got[len(got)-1])
+	}
+}
+
+func TestGetDictOrder(t *testing.T) {
+	d := NewDictBuilder()
+	d.Add([]any{"alpha1", "alpha1", "gamma1", "gamma1", "beta", "beta", "longer string", "longer string", "once"})
+	want := []string{"longer string", "alpha1", "gamma1"}
+	for i := 0; i < 10; i++ {
+		if diff := cmp.Diff(want, d.GetDict(3)); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package muon
+
+// An Option configures how values are written or read. Options are accepted
+// by Marshal, NewEncoder and NewMuWriter on the writing side and Unmarshal,
+// NewDecoder and NewMuReader on the reading side; options that don't apply
+// to a writer or reader are ignored by it.
+type Option func(*options)
+
+type options struct {
+	canonical       bool
+	compactFloats   bool
+	integralFloats  bool
+	nativeInts      bool
+	nonFiniteAsNull bool
+	orderedMaps     bool
+	lruSize         int
+	dynamicLRUSize  int
+	dictionary      []string
+	shared          *Dictionary
+	sizeTags        bool
+	countTags       bool
+	alignArrays     bool
+	borrowed        bool
+}
+
+// defaultLRUSize is the size of the LRU on both sides, and of the writer's
+// table of strings waiting to be added to it, unless options say otherwise.
+const defaultLRUSize = 512
+
+func newOptions(opts []Option) options {
+	o := options{lruSize: defaultLRUSize, dynamicLRUSize: defaultLRUSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCompactFloats writes each float as the narrowest of f16, f32 and f64
+// that holds it exactly, so that values like 0.5 or 1e10 take 3 or 5 bytes
+// instead of 9. Without it, float32 values are written as f32 and float64
+// values as f64.
+func WithCompactFloats() Option {
+	return func(o *options) { o.compactFloats = true }
+}
+
+// WithIntegralFloats writes floats that hold whole numbers between -2^53 and
+// 2^53 as integers, so that 3.0 takes a single byte. Such values read back
+// into float destinations unchanged, but come back as integers when read
+// into an interface. Negative zero stays a float.
+func WithIntegralFloats() Option {
+	return func(o *options) { o.integralFloats = true }
+}
+
+// WithNativeInts makes LEB128 integers that fit in an int64 or uint64 come
+// back as those types when read into an interface. By default they come
+// back as *big.Int, whatever their size, so that values which happen to be
+// small don't change type. Typed arrays of LEB128 integers are []int64
+// either way, unless an element doesn't fit.
+func WithNativeInts() Option {
+	return func(o *options) { o.nativeInts = true }
+}
+
+// WithNonFiniteAsNull makes NaN and the infinities read as null, for callers
+// that can't handle them. By default they are read as math.NaN(),
+// math.Inf(-1) and math.Inf(1). ToJSON has its own policy for them.
+func WithNonFiniteAsNull() Option {
+	return func(o *options) { o.nonFiniteAsNull = true }
+}
+
+// WithOrderedMaps makes dicts read into an interface come back as
+// OrderedMaps, which keep the order of their keys, instead of as maps.
+func WithOrderedMaps() Option {
+	return func(o *options) { o.orderedMaps = true }
+}
+
+// WithCanonical writes values in a canonical form, so that equal values are
+// written as the same bytes and documents can be hashed, signed or used as
+// cache keys. Map, struct and OrderedMap entries are sorted by key: null
+// first, then false and true, numbers by value and strings by their bytes.
+// Floats take their narrowest exact form, as with WithCompactFloats.
+// Integers always take their shortest form. Marshaler implementations are
+// responsible for their own output.
+func WithCanonical() Option {
+	return func(o *options) {
+		o.canonical = true
+		o.compactFloats = true
+	}
+}
+
+// WithLRUSize sets the number of strings the LRU holds. Writers only refer to
+// that many of the most recently added strings, and readers only keep that
+// many, so a reader needs an LRU at least as large as the writer's; it
+// reports a *SyntaxError for references beyond its size. Smaller LRUs save
+// memory on the reader at the cost of compression. The default is 512, and a
+// size of 0 is the same as WithoutLRU.
+func WithLRUSize(n int) Option {
+	return func(o *options) { o.lruSize = n }
+}
+
+// WithDynamicLRUSize sets the number of strings a writer keeps waiting to be
+// added to the LRU, which are added the first time they are written. The
+// default is 512. Readers ignore it.
+func WithDynamicLRUSize(n int) Option {
+	return func(o *options) { o.dynamicLRUSize = n }
+}
+
+// WithDictionary gives a writer the strings to add to the LRU the first time
+// they are written, as AddLRUDynamic does, such as those returned by
+// DictBuilder.GetDict. Strings beyond the size set by WithDynamicLRUSize are
+// dropped, so the most valuable should come first. Readers ignore it, since
+// the stream carries the strings.
+func WithDictionary(strs []string) Option {
+	return func(o *options) { o.dictionary = strs }
+}
+
+// WithoutLRU turns the LRU off: a writer neither adds strings to it nor
+// refers to them, and a reader reports references to it as errors. It saves
+// the memory of the LRU where the strings of a document rarely repeat.
+func WithoutLRU() Option {
+	return func(o *options) { o.lruSize = 0 }
+}
+
+// WithSharedDictionary loads the strings of d into the LRU before the stream
+// starts, on both sides. Writers record the ID of d at the start of the
+// stream, and readers check it.
+//
+// The ID is written with the tag 0x8D, which is an extension of this package
+// and not part of the MuON spec: other readers reject such streams, and
+// writers other than this package's don't produce them.
+func WithSharedDictionary(d *Dictionary) Option {
+	return func(o *options) { o.shared = d }
+}
+
+// WithSizeTags writes a size tag in front of every list and dict, and of
+// strings of 64 bytes or more, giving the number of bytes they take, so that
+// readers can skip them without parsing them. To do that, writers hold each
+// list and dict in memory until it is complete. They also don't add strings
+// to the LRU on their own, as with AddLRUDynamic or WithDictionary, since
+// readers that skip a value would miss strings added in it.
+//
+// Readers with the option jump over lists and dicts with size tags when
+// skipping them, trusting that the stream was written with the option and
+// so has no strings added to the LRU inside them. Readers without it read
+// through lists and dicts, since other writers may add strings there, and
+// only jump over other values.
+func WithSizeTags() Option {
+	return func(o *options) { o.sizeTags = true }
+}
+
+// WithCountTags writes a count tag in front of every list and dict, giving
+// its number of elements or entries, which readers use to make room for them
+// up front. Like WithSizeTags, it makes writers hold each list and dict in
+// memory until it is complete.
+func WithCountTags() Option {
+	return func(o *options) { o.countTags = true }
+}
+
+// WithAlignedArrays writes 0xFF padding in front of typed arrays so that
+// their elements start at a multiple of their size from the start of the
+// output: 2 bytes for int16 and float16 arrays, 4 for 32-bit ones and 8 for
+// 64-bit ones. A reader of a memory-mapped file can then use the elements in
+// place. Only the first chunk of a chunked array is aligned, and arrays
+// inside lists and dicts with size or count tags aren't, since where those
+// end up isn't known when they are written. The option has no effect in
+// canonical mode.
+func WithAlignedArrays() Option {
+	return func(o *options) { o.alignArrays = true }
+}
+
+// WithBorrowed makes readers of a []byte, Unmarshal and NewBytesDecoder,
+// return strings and typed arrays that share memory with it instead of
+// copies of it, so that reading them costs no allocations. This is unsafe:
+// the data must not change for as long as any of those values are in use,
+// as strings would change along with it. Typed arrays are only shared if
+// their elements are aligned, as WithAlignedArrays writes them, and the
+// machine is little-endian, like MuON; others are copied. Readers of an
+// io.Reader ignore the option.
+func WithBorrowed() Option {
+	return func(o *options) { o.borrowed = true }
+}
@@ -0,0 +1,113 @@
+package muon
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// OrderedMap is a dict that keeps the order of its keys. The encoder writes
+// its entries in order, and the decoder produces OrderedMaps instead of maps
+// when given the WithOrderedMaps option, or when decoding into an
+// OrderedMap.
+type OrderedMap []KeyValue
+
+// KeyValue is an entry of an OrderedMap. Key may be a value of any type,
+// though only strings can be written to JSON unchanged.
+type KeyValue struct {
+	Key   any
+	Value any
+}
+
+// Get returns the value of the first entry with the given key. Numeric keys
+// match by value, so Get(1) finds the key 1 whether it was read as a uint8 or
+// an int64.
+func (m OrderedMap) Get(key any) (any, bool) {
+	for _, kv := range m {
+		if keyEqual(kv.Key, key) {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalMuON writes m as a dict, keeping the order of its entries, except
+// in canonical mode, where they are sorted by key.
+func (m OrderedMap) MarshalMuON(e *Encoder) error {
+	if m == nil {
+		return e.Null()
+	}
+	if e.mw.opts.canonical {
+		m = sortedEntries(m)
+	}
+	e.BeginDict()
+	for _, kv := range m {
+		e.Encode(kv.Key)
+		e.Encode(kv.Value)
+	}
+	return e.EndDict()
+}
+
+// UnmarshalMuON reads a dict into m, keeping the order of its entries. The
+// values are read as by Decode into an interface, so nested dicts are maps
+// unless the Decoder has the WithOrderedMaps option.
+func (m *OrderedMap) UnmarshalMuON(d *Decoder) error {
+	tag, err := d.mr.nextTag()
+	if err != nil {
+		return err
+	}
+	if tag != 0x92 {
+		return d.mr.mismatch("non-dict value", reflect.ValueOf(m).Elem())
+	}
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+	res := OrderedMap{}
+	for d.More() {
+		var kv KeyValue
+		if err := d.Decode(&kv.Key); err != nil {
+			return err
+		}
+		if err := d.Decode(&kv.Value); err != nil {
+			return err
+		}
+		res = append(res, kv)
+	}
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+	*m = res
+	return nil
+}
+
+// MarshalJSON writes m as a JSON object, keeping the order of its entries.
+// Keys that aren't strings are written as the strings of their values, as
+// by ToJSON.
+func (m OrderedMap) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, kv := range m {
+		key, err := jsonKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		b, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte(':')
+		if b, err = json.Marshal(kv.Value); err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package muon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOrderedMap(t *testing.T) {
+	in := OrderedMap{
+		{"zeta", uint8(1)},
+		{"alpha", []any{"x", true}},
+		{"mid", OrderedMap{{"y", uint8(2)}, {"b", nil}}},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x92zeta\x00\xA1alpha\x00\x90x\x00\xAB\x91mid\x00\x92y\x00\xA2b\x00\xAC\x93\x93")
+	if diff := cmp.Diff(want, b); diff != "" {
+		t.Error(diff)
+	}
+
+	var got any
+	if err := Unmarshal(b, &got, WithOrderedMaps()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(any(in), got); diff != "" {
+		t.Error(diff)
+	}
+
+	// Only the top level is ordered without WithOrderedMaps.
+	var om OrderedMap
+	if err := Unmarshal(b, &om); err != nil {
+		t.Fatal(err)
+	}
+	if len(om) != 3 || om[0].Key != "zeta" || om[2].Key != "mid" {
+		t.Errorf("got %v, want the keys in order", om)
+	}
+	if mid, _ := om.Get("mid"); !cmp.Equal(mid, map[string]any{"y": uint8(2), "b": nil}) {
+		t.Errorf("got mid %v, want a map", mid)
+	}
+
+	var s struct{ Config OrderedMap }
+	if err := Unmarshal([]byte("\x92Config\x00\x92b\x00\xA1a\x00\xA2\x93\x93"), &s); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(OrderedMap{{"b", uint8(1)}, {"a", uint8(2)}}, s.Config); diff != "" {
+		t.Error(diff)
+	}
+
+	j, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"zeta":1,"alpha":["x",true],"mid":{"y":2,"b":null}}` {
+		t.Errorf("got JSON %s", j)
+	}
+}
+
+func TestOrderedMapErrors(t *testing.T) {
+	var om OrderedMap
+	var typeErr *UnmarshalTypeError
+	if err := Unmarshal([]byte{0x90, 0xA1, 0x91}, &om); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for a list, want *UnmarshalTypeError", err)
+	}
+
+	// the rest of the stream is still readable after the mismatch
+	d := NewDecoder(bytes.NewReader([]byte{0x90, 0xA1, 0x91, 0xA2}))
+	if err := d.Decode(&om); !errors.As(err, &typeErr) {
+		t.Errorf("got error %v for a list, want *UnmarshalTypeError", err)
+	}
+	var n int
+	if err := d.Decode(&n); err != nil || n != 2 {
+		t.Errorf("got %d, %v after the mismatch, want 2", n, err)
+	}
+}
+
+func TestOrderedMapKeys(t *testing.T) {
+	om := OrderedMap{{"b", 1}, {uint8(2), "two"}, {nil, 0}, {-1.5, "f"}, {true, "t"}, {[]any{1}, "list"}, {"a", 2}}
+	if v, ok := om.Get(2); !ok || v != "two" {
+		t.Errorf("got %v, %v for Get(2), want two", v, ok)
+	}
+	if v, ok := om.Get([]any{1}); ok {
+		t.Errorf("got %v for Get of a list, want nothing", v)
+	}
+
+	b, err := Marshal(om, WithCanonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got OrderedMap
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	var keys []any
+	for _, kv := range got {
+		keys = append(keys, kv.Key)
+	}
+	// canonical floats are compact, so -1.5 comes back as an f16
+	want := []any{nil, true, Float16From(-1.5), uint8(2), "a", "b", []any{uint8(1)}}
+	if diff := cmp.Diff(want, keys); diff != "" {
+		t.Error(diff)
+	}
+
+	j, err := json.Marshal(om[:5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"b":1,"2":"two","null":0,"-1.5":"f","true":"t"}` {
+		t.Errorf("got JSON %s", j)
+	}
+	if _, err := json.Marshal(om); err == nil {
+		t.Error("got no error for a list key in JSON")
+	}
+}
@@ -0,0 +1,68 @@
+#!/usr/bin/env python3
+"""Writes ints-py.txt, the encodings of integers by the reference Python
+MuON implementation (https://github.com/vshymanskyy/muon), which
+TestIntEncodingReference compares with the Go writer's.
+
+    pip install git+https://github.com/vshymanskyy/muon
+    python3 ints.py > ints-py.txt
+
+Where the reference package isn't installed, `python3 ints.py --rules`
+uses encode_int below instead, which follows the reference writer's rules
+for integers without sharing any code with the Go writer. The first line of
+the output says which of the two produced it.
+
+Each other line is an integer in decimal and its encoding in hex.
+"""
+
+import sys
+
+values = [0, 9, 10, 63, 64, 127, 128, 255, 256, 1000, 65535, 65536, 2**20,
+          2**32 - 1, 2**32, 2**41, 2**48, 2**55 - 1, 2**55, 2**56,
+          2**63 - 1, 2**63, 2**64 - 1, 2**64]
+values += [-v for v in values[1:]] + [-129, -32769, -100000, -2**31 - 1,
+                                     -2**63 - 1, -2**64 - 1]
+
+
+def sleb128(v):
+    out = bytearray()
+    while True:
+        b = v & 0x7F
+        v >>= 7
+        if (v == 0 and not b & 0x40) or (v == -1 and b & 0x40):
+            out.append(b)
+            return bytes(out)
+        out.append(b | 0x80)
+
+
+def encode_int(v):
+    """Digits for 0 to 9, otherwise the smallest fixed width type that holds
+    v, unless LEB128 is strictly shorter, and LEB128 beyond 64 bits."""
+    if 0 <= v <= 9:
+        return bytes([0xA0 + v])
+    leb = sleb128(v)
+    tags = (0xB0, 0xB1, 0xB2, 0xB3) if v < 0 else (0xB4, 0xB5, 0xB6, 0xB7)
+    for tag, size in zip(tags, (1, 2, 4, 8)):
+        bits = 8 * size
+        fits = -(1 << (bits - 1)) <= v if v < 0 else v < 1 << bits
+        if fits and (size == 1 or len(leb) >= size):
+            return bytes([tag]) + v.to_bytes(size, "little", signed=v < 0)
+    return b"\xBB" + leb
+
+
+def main():
+    if "--rules" in sys.argv[1:]:
+        print("# encode_int in ints.py, following the reference writer's rules")
+        encode = encode_int
+    else:
+        import muon
+        print("# muon.dumps, the reference Python implementation")
+        magic = b"\x8F\xB5\x30\x31"
+
+        def encode(v):
+            b = muon.dumps(v)
+            return b[len(magic):] if b.startswith(magic) else b
+    for v in values:
+        print(v, encode(v).hex())
+
+
+main()
@@ -0,0 +1,543 @@
+package muon
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+// Unmarshal decodes the MuON value in data and stores it in the value pointed
+// to by v, reversing the rules used by Marshal. Dict keys are matched to
+// struct fields by name, falling back to a case-insensitive match, and keys
+// without a matching field are ignored.
+//
+// Integers of any size can be stored in a big.Int or *big.Int. Stored in an
+// interface, integers too big for the fixed width types come back as
+// *big.Int, and so do small ones written in the LEB128 form unless the
+// WithNativeInts option is given.
+//
+// data must hold exactly one value, apart from padding; anything after the
+// value is a *SyntaxError. Streams of values are read with a Decoder.
+func Unmarshal(data []byte, v any, opts ...Option) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	mr := newMuReader(newDataReader(data), newOptions(opts))
+	if err := mr.decodeValue(rv.Elem()); err != nil {
+		return mr.wrapErr(0, err)
+	}
+	return mr.end()
+}
+
+// end checks that nothing but padding is left of the input.
+func (mr *muReader) end() error {
+	for {
+		b, err := mr.peekByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			return mr.syntaxError(b, nil, "data after the value")
+		}
+		mr.inp.ReadByte()
+	}
+}
+
+// decodeValue reads the next value into v, which must be settable.
+func (mr *muReader) decodeValue(v reflect.Value) error {
+	tag, err := mr.nextTag()
+	if err != nil {
+		return err
+	}
+
+	if tag == 0xAC {
+		if _, err := mr.inp.ReadByte(); err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	if t := v.Type(); t == bigIntType || t == bigIntType.Elem() {
+		return mr.decodeBigInt(v)
+	}
+
+	u, tu, v := indirect(v)
+	if u != nil {
+		// the value has started, so running out of input is never clean here
+		return mr.wrapErr(tag, u.UnmarshalMuON(mr.decoder()))
+	}
+	if tu != nil {
+		off := mr.inp.off
+		obj, err := mr.readObject()
+		if err != nil {
+			return err
+		}
+		s, ok := obj.(string)
+		if !ok {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("%T", obj), Type: reflect.TypeOf(tu), Offset: off}
+		}
+		return tu.UnmarshalText([]byte(s))
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		obj, err := mr.readObject()
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(obj))
+		}
+		return nil
+	}
+
+	switch tag {
+	case 0x90:
+		return mr.decodeList(v)
+	case 0x92:
+		return mr.decodeDict(v)
+	}
+	off := mr.inp.off
+	obj, err := mr.readObject()
+	if err != nil {
+		return err
+	}
+	return assign(v, obj, off)
+}
+
+var (
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// indirect follows pointers in v, allocating them as needed, until it gets to
+// a non-pointer value. If it finds an Unmarshaler or TextUnmarshaler on the
+// way, it stops there and returns it.
+func indirect(v reflect.Value) (Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	// Start from the address of named types so that methods with pointer
+	// receivers are found, like encoding/json does.
+	v0 := v
+	haveAddr := false
+	if v.Kind() != reflect.Pointer && v.Type().Name() != "" && v.CanAddr() {
+		haveAddr = true
+		v = v.Addr()
+	}
+	for {
+		// Decode into the value an interface points to, if there is one.
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Pointer && !e.IsNil() {
+				haveAddr = false
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Pointer {
+			return nil, nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Implements(unmarshalerType) {
+			return v.Interface().(Unmarshaler), nil, reflect.Value{}
+		}
+		if v.Type().Implements(textUnmarshalerType) {
+			return nil, v.Interface().(encoding.TextUnmarshaler), reflect.Value{}
+		}
+		if haveAddr {
+			v = v0
+			haveAddr = false
+		} else {
+			v = v.Elem()
+		}
+	}
+}
+
+// decodeBigInt reads an integer of any size into v, a big.Int or *big.Int.
+// These are TextUnmarshalers, but MuON integers aren't strings.
+func (mr *muReader) decodeBigInt(v reflect.Value) error {
+	off := mr.inp.off
+	obj, err := mr.readObject()
+	if err != nil {
+		return err
+	}
+	var n *big.Int
+	switch rv := reflect.ValueOf(obj); rv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = big.NewInt(rv.Int())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = new(big.Int).SetUint64(rv.Uint())
+	default:
+		if n, _ = obj.(*big.Int); n == nil {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("%T", obj), Type: v.Type(), Offset: off}
+		}
+	}
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.ValueOf(n))
+	} else {
+		v.Set(reflect.ValueOf(n).Elem())
+	}
+	return nil
+}
+
+// mismatch skips the value that can't be stored in v and reports why.
+func (mr *muReader) mismatch(what string, v reflect.Value) error {
+	off := mr.inp.off
+	if err := mr.skip(); err != nil {
+		return err
+	}
+	return &UnmarshalTypeError{Value: what, Type: v.Type(), Offset: off}
+}
+
+func (mr *muReader) decodeList(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		if n := mr.prealloc(); v.Cap() < n {
+			v.Set(reflect.MakeSlice(v.Type(), 0, n))
+		}
+		v.SetLen(0)
+	case reflect.Array:
+	default:
+		return mr.mismatch("list", v)
+	}
+
+	b, err := mr.readByte(0)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for {
+		next, err := mr.peekByte()
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+		if next == 0x91 {
+			break
+		}
+
+		switch {
+		case v.Kind() == reflect.Slice:
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			err = mr.decodeValue(v.Index(i))
+		case i < v.Len():
+			err = mr.decodeValue(v.Index(i))
+		default: // more elements than the array can hold
+			err = mr.skip()
+		}
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+		i++
+	}
+	if _, err := mr.readByte(b); err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+	case reflect.Array:
+		for ; i < v.Len(); i++ {
+			v.Index(i).SetZero()
+		}
+	}
+	return nil
+}
+
+func (mr *muReader) decodeDict(v reflect.Value) error {
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		if kt := v.Type().Key(); !mapKeyKinds[kt.Kind()] && !reflect.PointerTo(kt).Implements(textUnmarshalerType) {
+			return mr.mismatch("dict", v)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), mr.prealloc()))
+		}
+	case reflect.Struct:
+		fields = cachedFields(v.Type())
+	default:
+		return mr.mismatch("dict", v)
+	}
+
+	b, err := mr.readByte(0)
+	if err != nil {
+		return err
+	}
+	for {
+		next, err := mr.peekByte()
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+		if next == 0x93 {
+			break
+		}
+
+		off := mr.inp.off
+		k, err := mr.readObject()
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+
+		if v.Kind() == reflect.Map {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := assignKey(key, k, off); err != nil {
+				if serr := mr.skip(); serr != nil {
+					return mr.wrapErr(b, serr)
+				}
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := mr.decodeValue(elem); err != nil {
+				return mr.wrapErr(b, err)
+			}
+			v.SetMapIndex(key, elem)
+			continue
+		}
+
+		// only string keys can name fields
+		fv, ok := reflect.Value{}, false
+		key, _ := k.(string)
+		if f := lookupField(fields, key); f != nil {
+			fv, ok = fieldByIndex(v, f.index, true)
+		}
+		if ok {
+			err = mr.decodeValue(fv)
+		} else {
+			err = mr.skip()
+		}
+		if err != nil {
+			return mr.wrapErr(b, err)
+		}
+	}
+	_, err = mr.readByte(b)
+	return err
+}
+
+// mapKeyKinds are the kinds of map keys that dicts can be decoded into,
+// besides types with UnmarshalText. Marshal rejects maps with other keys.
+var mapKeyKinds = map[reflect.Kind]bool{
+	reflect.String: true, reflect.Bool: true, reflect.Interface: true,
+	reflect.Int: true, reflect.Int8: true, reflect.Int16: true, reflect.Int32: true, reflect.Int64: true,
+	reflect.Uint: true, reflect.Uint8: true, reflect.Uint16: true, reflect.Uint32: true, reflect.Uint64: true,
+	reflect.Uintptr: true, reflect.Float32: true, reflect.Float64: true,
+}
+
+// assignKey stores the dict key k, read at offset off, in the map key v.
+// Keys that aren't strings are converted like values, except that an
+// interface gets the same keys as readDict produces. String keys go through
+// UnmarshalText if v has it and isn't a string, as addKey writes keys with
+// MarshalText.
+func assignKey(v reflect.Value, k any, off int64) error {
+	if s, ok := k.(string); ok && v.Kind() != reflect.String && reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if v.Kind() == reflect.Interface {
+		key, ok := mapKey(k)
+		if !ok {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("dict key of type %T", k), Type: v.Type(), Offset: off}
+		}
+		k = key
+	}
+	return assign(v, k, off)
+}
+
+func lookupField(fields []field, key string) *field {
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// assign stores a value returned by readObject in v. off is the offset of the
+// value, for errors.
+func assign(v reflect.Value, obj any, off int64) error {
+	mismatch := func(what string) error {
+		return &UnmarshalTypeError{Value: what, Type: v.Type(), Offset: off}
+	}
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return mismatch(fmt.Sprintf("%T", obj))
+		}
+		if obj == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(obj))
+		}
+		return nil
+	}
+
+	switch val := obj.(type) {
+	case nil:
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	case bool:
+		if v.Kind() != reflect.Bool {
+			return mismatch("bool")
+		}
+		v.SetBool(val)
+		return nil
+	case string:
+		if v.Kind() != reflect.String {
+			return mismatch("string")
+		}
+		v.SetString(val)
+		return nil
+	}
+
+	if a := reflect.ValueOf(obj); a.Kind() == reflect.Slice { // typed arrays
+		switch {
+		case v.Kind() == reflect.Slice && a.Type().ConvertibleTo(v.Type()):
+			v.Set(a.Convert(v.Type()))
+			return nil
+		case v.Kind() == reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), a.Len(), a.Len()))
+		case v.Kind() == reflect.Array:
+			for i := a.Len(); i < v.Len(); i++ {
+				v.Index(i).SetZero()
+			}
+		default:
+			return mismatch("typed array")
+		}
+		for i := 0; i < a.Len() && i < v.Len(); i++ {
+			if err := assign(v.Index(i), a.Index(i).Interface(), off); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return assignNumber(v, obj, mismatch)
+}
+
+func assignNumber(v reflect.Value, obj any, mismatch func(string) error) error {
+	var (
+		i     int64
+		u     uint64
+		f     float64
+		isInt bool // i holds the value
+		isUns bool // u holds the value
+	)
+	switch n := obj.(type) {
+	case int8:
+		i, isInt = int64(n), true
+	case int16:
+		i, isInt = int64(n), true
+	case int32:
+		i, isInt = int64(n), true
+	case int64:
+		i, isInt = n, true
+	case uint8:
+		u, isUns = uint64(n), true
+	case uint16:
+		u, isUns = uint64(n), true
+	case uint32:
+		u, isUns = uint64(n), true
+	case uint64:
+		u, isUns = n, true
+	case float32:
+		f = float64(n)
+	case float64:
+		f = n
+	case Float16:
+		f = float64(n.Float32())
+	case *big.Int:
+		switch {
+		case n.IsInt64():
+			i, isInt = n.Int64(), true
+		case n.IsUint64():
+			u, isUns = n.Uint64(), true
+		default:
+			return mismatch("number " + n.String())
+		}
+	default:
+		return mismatch(fmt.Sprintf("%T", obj))
+	}
+
+	desc := func() string {
+		switch {
+		case isInt:
+			return fmt.Sprintf("number %d", i)
+		case isUns:
+			return fmt.Sprintf("number %d", u)
+		}
+		return fmt.Sprintf("number %v", f)
+	}
+
+	if v.Type() == float16Type {
+		switch {
+		case isInt:
+			f = float64(i)
+		case isUns:
+			f = float64(u)
+		}
+		f16 := Float16From(float32(f))
+		if math.IsInf(float64(f16.Float32()), 0) && !math.IsInf(f, 0) {
+			return mismatch(desc())
+		}
+		v.SetUint(uint64(f16.Bits()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if isUns {
+			if u > math.MaxInt64 {
+				return mismatch(desc())
+			}
+			i, isInt = int64(u), true
+		}
+		if !isInt || v.OverflowInt(i) {
+			return mismatch(desc())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if isInt {
+			if i < 0 {
+				return mismatch(desc())
+			}
+			u, isUns = uint64(i), true
+		}
+		if !isUns || v.OverflowUint(u) {
+			return mismatch(desc())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case isInt:
+			f = float64(i)
+		case isUns:
+			f = float64(u)
+		}
+		if v.OverflowFloat(f) {
+			return mismatch(desc())
+		}
+		v.SetFloat(f)
+	default:
+		return mismatch(desc())
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Command muq prints the values that a query selects in MuON files, as
+// JSON, one per line.
+//
+//	muq '$.items[?(@.price < 10)].name' data.mu
+//
+// With no files, it reads standard input.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/benmuth/go-muon/src/muon"
+	"github.com/benmuth/go-muon/src/query"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs muq with the arguments args and returns its exit status. Output
+// is flushed before it returns, whatever the status.
+func run(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: muq query [file ...]")
+		return 2
+	}
+	q, err := query.Compile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	scan := func(r io.Reader) error {
+		d := muon.NewDecoder(r, muon.WithNativeInts())
+		for {
+			err := q.Run(d, func(v any) error {
+				b, err := muon.ToJSON(v, muon.NonFiniteString)
+				if err != nil {
+					return err
+				}
+				out.Write(b)
+				return out.WriteByte('\n')
+			})
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	files := args[1:]
+	if len(files) == 0 {
+		if err := scan(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	status := 0
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err == nil {
+			err = scan(f)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,314 @@
+package query
+
+import (
+	"errors"
+	"io"
+	"reflect"
+
+	"github.com/benmuth/go-muon/src/muon"
+)
+
+// Run reads the next value from d and calls fn with each value in it that q
+// selects, in the order they appear in the stream. Values are read as by
+// Decode into an interface, except that dicts are OrderedMaps, so they keep
+// the order of their entries. A value selected more than once, as with
+// $..*..*, is passed to fn once.
+//
+// Run returns io.EOF if there are no more values in d. If fn returns an
+// error, Run stops and returns it, leaving d in the middle of the value.
+func (q *Query) Run(d *muon.Decoder, fn func(v any) error) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	e := &evaluator{q: q, d: d, emit: fn}
+	return e.node(tok, []int{0})
+}
+
+// All returns the values that q selects in each of the values in r, in
+// order. The options are passed to the Decoder that reads r.
+func (q *Query) All(r io.Reader, opts ...muon.Option) ([]any, error) {
+	d := muon.NewDecoder(r, opts...)
+	var res []any
+	for {
+		err := q.Run(d, func(v any) error {
+			res = append(res, v)
+			return nil
+		})
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// An evaluator runs a query against one value of a stream.
+//
+// The progress of the query at a value is a set of states, sorted, each the
+// index of the first step the value is yet to match. A value whose states
+// include len(steps) matched the whole query and is selected.
+type evaluator struct {
+	q    *Query
+	d    *muon.Decoder
+	emit func(v any) error
+}
+
+// node evaluates the value that starts with tok, reading it from the
+// stream as far as needed. The value is only decoded if it is selected, or
+// it is a typed array, whose elements are scalars; otherwise its children
+// are evaluated one at a time.
+func (e *evaluator) node(tok muon.Token, states []int) error {
+	if e.selected(states) || tok.Kind == muon.TypedArrayChunk {
+		v, err := e.build(tok)
+		if err != nil {
+			return err
+		}
+		return e.value(v, states)
+	}
+	switch tok.Kind {
+	case muon.ListStart:
+		for i := 0; e.d.More(); i++ {
+			if err := e.child(states, child{index: i, list: true}); err != nil {
+				return err
+			}
+		}
+	case muon.DictStart:
+		for e.d.More() {
+			tok, err := e.d.Token()
+			if err != nil {
+				return err
+			}
+			key, err := e.build(tok)
+			if err != nil {
+				return err
+			}
+			if err := e.child(states, child{key: key}); err != nil {
+				return err
+			}
+		}
+	default: // scalars have nothing to select from
+		return nil
+	}
+	_, err := e.d.Token() // the end of the list or dict
+	return err
+}
+
+// child evaluates the next value in the stream, a child of a value with the
+// given states. It is skipped if nothing can select it or its descendants,
+// and decoded if a filter has to look at it.
+func (e *evaluator) child(states []int, c child) error {
+	if e.filtered(states) {
+		tok, err := e.d.Token()
+		if err != nil {
+			return err
+		}
+		if c.val, err = e.build(tok); err != nil {
+			return err
+		}
+		c.loaded = true
+		return e.value(c.val, e.q.children(states, c))
+	}
+	cs := e.q.children(states, c)
+	if len(cs) == 0 {
+		return e.d.Skip()
+	}
+	tok, err := e.d.Token()
+	if err != nil {
+		return err
+	}
+	return e.node(tok, cs)
+}
+
+// value evaluates v, a value that has been decoded.
+func (e *evaluator) value(v any, states []int) error {
+	if e.selected(states) {
+		if err := e.emit(v); err != nil {
+			return err
+		}
+	}
+	each := func(c child) error {
+		c.loaded = true
+		if cs := e.q.children(states, c); len(cs) > 0 {
+			return e.value(c.val, cs)
+		}
+		return nil
+	}
+	switch val := v.(type) {
+	case []any:
+		for i, el := range val {
+			if err := each(child{index: i, list: true, val: el}); err != nil {
+				return err
+			}
+		}
+	case muon.OrderedMap:
+		for _, kv := range val {
+			if err := each(child{key: kv.Key, val: kv.Value}); err != nil {
+				return err
+			}
+		}
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := each(child{index: i, list: true, val: rv.Index(i).Interface()}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selected reports whether a value with the given states is selected.
+func (e *evaluator) selected(states []int) bool {
+	return len(states) > 0 && states[len(states)-1] == len(e.q.steps)
+}
+
+// filtered reports whether the children of a value with the given states
+// go through a filter.
+func (e *evaluator) filtered(states []int) bool {
+	for _, s := range states {
+		if s < len(e.q.steps) && e.q.steps[s].filter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// child is an element of a list or typed array, or a value of a dict.
+type child struct {
+	index  int // index in a list
+	key    any // key in a dict
+	list   bool
+	val    any
+	loaded bool // val is set
+}
+
+// children returns the states of c, a child of a value with the given
+// states. Filters only match children that are loaded.
+func (q *Query) children(states []int, c child) []int {
+	var res []int
+	for _, s := range states {
+		if s == len(q.steps) {
+			continue
+		}
+		st := &q.steps[s]
+		if st.recursive {
+			res = addState(res, s)
+		}
+		if st.match(c) {
+			res = addState(res, s+1)
+		}
+	}
+	return res
+}
+
+// addState adds s to the sorted set of states.
+func addState(states []int, s int) []int {
+	i := 0
+	for i < len(states) && states[i] < s {
+		i++
+	}
+	if i < len(states) && states[i] == s {
+		return states
+	}
+	states = append(states, 0)
+	copy(states[i+1:], states[i:])
+	states[i] = s
+	return states
+}
+
+func (st *step) match(c child) bool {
+	switch {
+	case st.wildcard:
+		return true
+	case st.filter != nil:
+		return c.loaded && st.filter.test(c.val)
+	case c.list:
+		for _, i := range st.indexes {
+			if i == c.index {
+				return true
+			}
+		}
+		for _, r := range st.ranges {
+			if c.index >= r.start && (r.end < 0 || c.index < r.end) {
+				return true
+			}
+		}
+		return false
+	}
+	if s, ok := c.key.(string); ok {
+		for _, name := range st.names {
+			if name == s {
+				return true
+			}
+		}
+		return false
+	}
+	if !isNumber(c.key) {
+		return false
+	}
+	for _, i := range st.indexes {
+		if compare(c.key, i, "==") {
+			return true
+		}
+	}
+	return false
+}
+
+// build decodes the value that starts with tok.
+func (e *evaluator) build(tok muon.Token) (any, error) {
+	switch tok.Kind {
+	case muon.ListStart:
+		res := []any{}
+		for e.d.More() {
+			v, err := e.next()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		_, err := e.d.Token()
+		return res, err
+	case muon.DictStart:
+		res := muon.OrderedMap{}
+		for e.d.More() {
+			k, err := e.next()
+			if err != nil {
+				return nil, err
+			}
+			v, err := e.next()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, muon.KeyValue{Key: k, Value: v})
+		}
+		_, err := e.d.Token()
+		return res, err
+	case muon.TypedArrayChunk:
+		arr := tok.Value
+		for tok.More {
+			var err error
+			if tok, err = e.d.Token(); err != nil {
+				return nil, err
+			}
+			arr = muon.AppendArrayChunk(arr, tok.Value)
+		}
+		return arr, nil
+	case muon.ListEnd, muon.DictEnd:
+		return nil, errors.New("query: unexpected end of list or dict")
+	}
+	return tok.Value, nil
+}
+
+// next decodes the next value in the stream.
+func (e *evaluator) next() (any, error) {
+	tok, err := e.d.Token()
+	if err != nil {
+		return nil, err
+	}
+	return e.build(tok)
+}
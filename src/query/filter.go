@@ -0,0 +1,316 @@
+package query
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/benmuth/go-muon/src/muon"
+)
+
+// expr is a filter test, evaluated against an element.
+type expr interface {
+	test(v any) bool
+}
+
+type orExpr struct{ a, b expr }
+
+func (e orExpr) test(v any) bool { return e.a.test(v) || e.b.test(v) }
+
+type andExpr struct{ a, b expr }
+
+func (e andExpr) test(v any) bool { return e.a.test(v) && e.b.test(v) }
+
+type notExpr struct{ a expr }
+
+func (e notExpr) test(v any) bool { return !e.a.test(v) }
+
+// existsExpr tests that an element has a value at a path.
+type existsExpr struct{ path []any }
+
+func (e existsExpr) test(v any) bool {
+	_, ok := resolve(v, e.path)
+	return ok
+}
+
+// compareExpr compares two operands. A path that the element doesn't have
+// is equal to nothing and unequal to everything.
+type compareExpr struct {
+	op   string
+	a, b operand
+}
+
+func (e compareExpr) test(v any) bool {
+	a, aok := e.a.value(v)
+	b, bok := e.b.value(v)
+	if !aok || !bok {
+		return e.op == "!="
+	}
+	return compare(a, b, e.op)
+}
+
+// operand is a path relative to the element, or a literal.
+type operand struct {
+	isPath bool
+	path   []any // keys and indexes
+	lit    any
+}
+
+func (o operand) value(v any) (any, bool) {
+	if o.isPath {
+		return resolve(v, o.path)
+	}
+	return o.lit, true
+}
+
+// resolve returns the value at path in v, a value built by the evaluator.
+func resolve(v any, path []any) (any, bool) {
+	for _, p := range path {
+		switch val := v.(type) {
+		case muon.OrderedMap:
+			var ok bool
+			if v, ok = val.Get(p); !ok {
+				return nil, false
+			}
+		case []any:
+			i, ok := p.(int)
+			if !ok || i >= len(val) {
+				return nil, false
+			}
+			v = val[i]
+		default:
+			rv := reflect.ValueOf(v)
+			i, ok := p.(int)
+			if !ok || rv.Kind() != reflect.Slice || i >= rv.Len() {
+				return nil, false
+			}
+			v = rv.Index(i).Interface()
+		}
+	}
+	return v, true
+}
+
+var comparisons = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// compare applies op to a and b. Numbers compare by value, whatever their
+// types, and strings by their bytes; other values are only equal to equal
+// values of the same kind. NaN is only unequal.
+func compare(a, b any, op string) bool {
+	var c int
+	switch {
+	case isNumber(a) && isNumber(b):
+		fa, fb := bigFloat(a), bigFloat(b)
+		if fa == nil || fb == nil { // NaN
+			return op == "!="
+		}
+		c = fa.Cmp(fb)
+	case isString(a) && isString(b):
+		c = strings.Compare(a.(string), b.(string))
+	default:
+		eq := a == nil && b == nil
+		if ab, ok := a.(bool); ok {
+			bb, ok := b.(bool)
+			eq = ok && ab == bb
+		}
+		switch op {
+		case "==":
+			return eq
+		case "!=":
+			return !eq
+		}
+		return false
+	}
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func isString(v any) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func isNumber(v any) bool {
+	switch v := v.(type) {
+	case *big.Int:
+		return v != nil
+	case muon.Float16:
+		return true
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// bigFloat returns the number v exactly, or nil if it is NaN.
+func bigFloat(v any) *big.Float {
+	var f float64
+	switch v := v.(type) {
+	case *big.Int:
+		return new(big.Float).SetInt(v)
+	case muon.Float16:
+		f = float64(v.Float32())
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return new(big.Float).SetInt64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return new(big.Float).SetUint64(rv.Uint())
+		}
+		f = rv.Float()
+	}
+	if math.IsNaN(f) {
+		return nil
+	}
+	return new(big.Float).SetFloat64(f)
+}
+
+// or parses a filter test, up to the first token that can't continue it.
+func (p *parser) or() (expr, error) {
+	a, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if !p.consume("||") {
+			return a, nil
+		}
+		b, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a = orExpr{a, b}
+	}
+}
+
+func (p *parser) and() (expr, error) {
+	a, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if !p.consume("&&") {
+			return a, nil
+		}
+		b, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a = andExpr{a, b}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	p.skipSpace()
+	switch {
+	case p.consume("!"):
+		a, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{a}, nil
+	case p.consume("("):
+		a, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, p.errorf("missing )")
+		}
+		return a, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	for _, op := range comparisons {
+		if p.consume(op) {
+			p.skipSpace()
+			b, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			return compareExpr{op, a, b}, nil
+		}
+	}
+	if !a.isPath {
+		return nil, p.errorf("literal without comparison")
+	}
+	return existsExpr{a.path}, nil
+}
+
+func (p *parser) operand() (operand, error) {
+	start := p.pos
+	switch c := p.peek(); {
+	case c == '@':
+		p.pos++
+		steps, err := p.segments()
+		if err != nil {
+			return operand{}, err
+		}
+		var path []any
+		for _, st := range steps {
+			if st.recursive || st.wildcard || st.filter != nil || len(st.ranges) > 0 || len(st.names)+len(st.indexes) != 1 {
+				p.pos = start
+				return operand{}, p.errorf("filter paths can only have keys and indexes")
+			}
+			if len(st.names) > 0 {
+				path = append(path, st.names[0])
+			} else {
+				path = append(path, st.indexes[0])
+			}
+		}
+		return operand{isPath: true, path: path}, nil
+	case c == '\'' || c == '"':
+		s, err := p.quoted()
+		return operand{lit: s}, err
+	case c == '-' || c >= '0' && c <= '9':
+		for p.pos < len(p.s) && strings.IndexByte("+-.0123456789eE", p.s[p.pos]) >= 0 {
+			p.pos++
+		}
+		lit := p.s[start:p.pos]
+		if i, ok := new(big.Int).SetString(lit, 10); ok {
+			return operand{lit: i}, nil
+		}
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			p.pos = start
+			return operand{}, p.errorf("bad number")
+		}
+		return operand{lit: f}, nil
+	}
+	for _, kw := range []struct {
+		s string
+		v any
+	}{{"true", true}, {"false", false}, {"null", nil}} {
+		if p.consume(kw.s) {
+			return operand{lit: kw.v}, nil
+		}
+	}
+	return operand{}, p.errorf("bad operand")
+}
@@ -0,0 +1,363 @@
+// Package query evaluates JSONPath-like expressions against MuON streams.
+//
+// A query starts with $, the value being queried, and is followed by
+// segments that select children of the values selected so far:
+//
+//	.name, ['name']    the value of the key name in a dict
+//	[0], [2:5], [3:]   elements of a list or typed array, by index or range
+//	.*, [*]            every element of a list or value of a dict
+//	['a','b'], [0,2]   the union of several of the above
+//	[?(@.price < 10)]  the elements or values for which a filter holds
+//	..name, ..*, ..[0] as above, but among all descendants instead of
+//	                   only children
+//
+// Filters compare values at paths relative to the element, @, with each
+// other or with literals: numbers, 'strings', true, false and null, using
+// ==, !=, <, <=, > and >=. A path on its own tests that the element has it.
+// Tests combine with &&, || and !, and group with parentheses.
+//
+// Indexes are never negative, since streams are read from the front and
+// the length of a list is only known at its end. Ints also match dict keys
+// with the same numeric value, as the keys of MuON dicts needn't be strings.
+//
+// Queries are evaluated while the stream is read: values that nothing
+// selects are skipped without being decoded, and only the values selected,
+// and the elements that filters look at, are decoded.
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// SyntaxError describes a malformed query.
+type SyntaxError struct {
+	Expr   string
+	Offset int // byte offset in Expr at which the error was detected
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query: %s at offset %d of %q", e.msg, e.Offset, e.Expr)
+}
+
+// A Query is a compiled query. It is safe for concurrent use.
+type Query struct {
+	expr  string
+	steps []step
+}
+
+// step is a segment of a query. It selects the children of a value that
+// match it, or its descendants if it is recursive.
+type step struct {
+	recursive bool
+	wildcard  bool
+	names     []string
+	indexes   []int
+	ranges    []indexRange
+	filter    expr // nil unless the step is a filter
+}
+
+// indexRange is a range of list indexes, from start up to but not
+// including end. end is -1 for ranges that don't end.
+type indexRange struct {
+	start, end int
+}
+
+// Compile parses a query.
+func Compile(s string) (*Query, error) {
+	p := &parser{s: s}
+	steps, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	return &Query{expr: s, steps: steps}, nil
+}
+
+// MustCompile is like Compile but panics if the query can't be parsed.
+func MustCompile(s string) *Query {
+	q, err := Compile(s)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// String returns the text the query was compiled from.
+func (q *Query) String() string {
+	return q.expr
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &SyntaxError{Expr: p.s, Offset: p.pos, msg: fmt.Sprintf(format, args...)}
+}
+
+// peek returns the next byte, or 0 at the end of the query.
+func (p *parser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// consume skips prefix if the rest of the query starts with it.
+func (p *parser) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n\r", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *parser) query() ([]step, error) {
+	p.skipSpace()
+	if !p.consume("$") {
+		return nil, p.errorf("query must start with $")
+	}
+	steps, err := p.segments()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return steps, nil
+}
+
+// segments parses the segments that follow $ or @.
+func (p *parser) segments() ([]step, error) {
+	var steps []step
+	for {
+		var (
+			st  step
+			err error
+		)
+		switch {
+		case p.consume(".."):
+			st.recursive = true
+			switch p.peek() {
+			case '[':
+				err = p.bracket(&st)
+			case '*':
+				p.pos++
+				st.wildcard = true
+			default:
+				err = p.name(&st)
+			}
+		case p.consume("."):
+			if p.consume("*") {
+				st.wildcard = true
+			} else {
+				err = p.name(&st)
+			}
+		case p.peek() == '[':
+			err = p.bracket(&st)
+		default:
+			return steps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, st)
+	}
+}
+
+// name parses a key that follows a dot.
+func (p *parser) name(st *step) error {
+	start := p.pos
+	for p.pos < len(p.s) {
+		r, n := utf8.DecodeRuneInString(p.s[p.pos:])
+		if r < utf8.RuneSelf && !isNameByte(byte(r)) {
+			break
+		}
+		p.pos += n
+	}
+	if p.pos == start {
+		return p.errorf("missing name")
+	}
+	st.names = append(st.names, p.s[start:p.pos])
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// bracket parses a bracketed selector or union of selectors.
+func (p *parser) bracket(st *step) error {
+	p.pos++ // [
+	p.skipSpace()
+	if p.consume("?") {
+		p.skipSpace()
+		f, err := p.or()
+		if err != nil {
+			return err
+		}
+		st.filter = f
+		p.skipSpace()
+		if !p.consume("]") {
+			return p.errorf("missing ]")
+		}
+		return nil
+	}
+	for {
+		p.skipSpace()
+		switch c := p.peek(); {
+		case c == '*':
+			p.pos++
+			st.wildcard = true
+		case c == '\'' || c == '"':
+			s, err := p.quoted()
+			if err != nil {
+				return err
+			}
+			st.names = append(st.names, s)
+		case c == ':' || c == '-' || c >= '0' && c <= '9':
+			if err := p.index(st); err != nil {
+				return err
+			}
+		default:
+			return p.errorf("bad selector")
+		}
+		p.skipSpace()
+		if p.consume("]") {
+			return nil
+		}
+		if !p.consume(",") {
+			return p.errorf("missing ]")
+		}
+	}
+}
+
+// index parses an index or a range of indexes.
+func (p *parser) index(st *step) error {
+	start, err := p.optInt()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if !p.consume(":") {
+		if start < 0 {
+			return p.errorf("missing index")
+		}
+		st.indexes = append(st.indexes, start)
+		return nil
+	}
+	p.skipSpace()
+	end, err := p.optInt()
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start = 0
+	}
+	st.ranges = append(st.ranges, indexRange{start, end})
+	return nil
+}
+
+// optInt parses a list index, if there is one, or returns -1.
+func (p *parser) optInt() (int, error) {
+	if p.peek() == '-' {
+		return 0, p.errorf("negative indexes aren't supported")
+	}
+	start := p.pos
+	for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+		p.pos++
+	}
+	if p.pos == start {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil || n > math.MaxInt32 {
+		p.pos = start
+		return 0, p.errorf("index out of range")
+	}
+	return n, nil
+}
+
+// quoted parses a string in single or double quotes, with JSON escapes.
+func (p *parser) quoted() (string, error) {
+	q := p.s[p.pos]
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.s) {
+			p.pos = start
+			return "", p.errorf("unterminated string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == q:
+			return b.String(), nil
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		if p.pos >= len(p.s) {
+			continue
+		}
+		e := p.s[p.pos]
+		p.pos++
+		switch e {
+		case '\\', '/', '\'', '"':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, ok := p.hex4(p.pos)
+			if !ok {
+				return "", p.errorf("bad escape")
+			}
+			p.pos += 4
+			// characters outside the BMP are escaped as surrogate pairs,
+			// as in JSON
+			if utf16.IsSurrogate(r) && strings.HasPrefix(p.s[p.pos:], `\u`) {
+				if r2, ok := p.hex4(p.pos + 2); ok {
+					if dec := utf16.DecodeRune(r, r2); dec != unicode.ReplacementChar {
+						r = dec
+						p.pos += 6
+					}
+				}
+			}
+			b.WriteRune(r)
+		default:
+			return "", p.errorf("bad escape")
+		}
+	}
+}
+
+// hex4 parses the 4 hex digits at i of a \u escape.
+func (p *parser) hex4(i int) (rune, bool) {
+	if i+4 > len(p.s) {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(p.s[i:i+4], 16, 16)
+	return rune(r), err == nil
+}
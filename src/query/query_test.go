@@ -0,0 +1,279 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/benmuth/go-muon/src/muon"
+)
+
+type item struct {
+	Name  string   `muon:"name"`
+	Price float64  `muon:"price"`
+	Qty   int      `muon:"qty"`
+	Tags  []string `muon:"tags,omitempty"`
+	Note  any      `muon:"note,omitempty"`
+}
+
+var store = muon.OrderedMap{
+	{Key: "name", Value: "corner shop"},
+	{Key: "items", Value: []item{
+		{Name: "tea", Price: 3.5, Qty: 10, Tags: []string{"hot", "drink"}},
+		{Name: "cake", Price: 12, Qty: 0, Note: "vegan"},
+		{Name: "juice", Price: 4.25, Qty: 3, Tags: []string{"cold", "drink"}, Note: true},
+		{Name: "pie", Price: math.NaN(), Qty: 1},
+	}},
+	{Key: "scores", Value: []uint16{3, 1, 4, 1, 5}},
+	{Key: "codes", Value: map[any]any{1: "one", 2: "two"}},
+	{Key: "owner", Value: muon.OrderedMap{
+		{Key: "name", Value: "ann"},
+		{Key: "price", Value: 99},
+	}},
+}
+
+func mustMarshal(t testing.TB, v any, opts ...muon.Option) []byte {
+	t.Helper()
+	b, err := muon.Marshal(v, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// jsonResults returns the values as JSON, one per line.
+func jsonResults(t *testing.T, vals []any) string {
+	t.Helper()
+	var lines []string
+	for _, v := range vals {
+		b, err := muon.ToJSON(v, muon.NonFiniteString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`$.name`, `"corner shop"`},
+		{`$['name']`, `"corner shop"`},
+		{`$.items[*].price`, "3.5\n12\n4.25\n\"NaN\""},
+		{`$.items[0,2].name`, "\"tea\"\n\"juice\""},
+		{`$.items[1:3].name`, "\"cake\"\n\"juice\""},
+		{`$.items[2:].name`, "\"juice\"\n\"pie\""},
+		{`$.items[:1].tags[1]`, `"drink"`},
+		{`$.items[9]`, ``},
+		{`$..price`, "3.5\n12\n4.25\n\"NaN\"\n99"},
+		{`$..name`, "\"corner shop\"\n\"tea\"\n\"cake\"\n\"juice\"\n\"pie\"\n\"ann\""},
+		{`$..tags[0]`, "\"hot\"\n\"cold\""},
+		{`$.owner.*`, "\"ann\"\n99"},
+		{`$.owner`, `{"name":"ann","price":99}`},
+		{`$.scores[1]`, `1`},
+		{`$.scores[?(@ >= 3)]`, "3\n4\n5"},
+		{`$.scores`, `[3,1,4,1,5]`},
+		{`$.codes[2]`, `"two"`},
+		{`$.items[?(@.price < 10)].name`, "\"tea\"\n\"juice\""},
+		{`$.items[?(@.price != 3.5)].name`, "\"cake\"\n\"juice\"\n\"pie\""},
+		{`$.items[?(@.price == 12 && @.qty == 0)].name`, `"cake"`},
+		{`$.items[?(@.qty > 5 || @.note == 'vegan')].name`, "\"tea\"\n\"cake\""},
+		{`$.items[?(@.note)].name`, "\"cake\"\n\"juice\""},
+		{`$.items[?(!@.note)].name`, "\"tea\"\n\"pie\""},
+		{`$.items[?(@.note == true)].name`, `"juice"`},
+		{`$.items[?(@.tags[1] == "drink")].name`, "\"tea\"\n\"juice\""},
+		{`$.items[?(@.name > 'p')].qty`, "10\n1"},
+		{`$.items[?((@.qty < 2 || @.qty > 5) && !(@.price > 100))].name`, "\"tea\"\n\"cake\"\n\"pie\""},
+		{`$.items[?@.qty == 3].name`, `"juice"`},
+		{`$..[?(@.price > 50)].name`, `"ann"`},
+		{`$..*[?(@ == 'drink')]`, "\"drink\"\n\"drink\""},
+	}
+	for _, opts := range [][]muon.Option{nil, {muon.WithSizeTags()}} {
+		b := mustMarshal(t, store, opts...)
+		for _, tt := range tests {
+			q, err := Compile(tt.query)
+			if err != nil {
+				t.Errorf("%s: %v", tt.query, err)
+				continue
+			}
+			vals, err := q.All(bytes.NewReader(b), opts...)
+			if err != nil {
+				t.Errorf("%s: %v", tt.query, err)
+				continue
+			}
+			if got := jsonResults(t, vals); got != tt.want {
+				t.Errorf("%s: got\n%s\nwant\n%s", tt.query, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQueryRecursive(t *testing.T) {
+	doc := muon.OrderedMap{{Key: "a", Value: muon.OrderedMap{{Key: "a", Value: []any{1, muon.OrderedMap{{Key: "a", Value: 2}}}}}}}
+	b := mustMarshal(t, doc)
+	vals, err := MustCompile(`$..a`).All(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"a\":[1,{\"a\":2}]}\n[1,{\"a\":2}]\n2"
+	if got := jsonResults(t, vals); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// each value is selected once, however many ways it matches
+	vals, err = MustCompile(`$..*..*`).All(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[1,{\"a\":2}]\n1\n{\"a\":2}\n2"
+	if got := jsonResults(t, vals); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := muon.NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		if err := enc.Encode(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := MustCompile(`$.n`)
+	vals, err := q.All(bytes.NewReader(buf.Bytes()), muon.WithNativeInts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := jsonResults(t, vals); got != "0\n1\n2" {
+		t.Errorf("got %q", got)
+	}
+
+	d := muon.NewDecoder(bytes.NewReader(buf.Bytes()))
+	errStop := errors.New("stop")
+	if err := q.Run(d, func(any) error { return errStop }); err != errStop {
+		t.Errorf("got %v, want the error from fn", err)
+	}
+	d = muon.NewDecoder(bytes.NewReader(nil))
+	if err := q.Run(d, func(any) error { return nil }); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
+
+// TestQueryChunkedArray checks that chunked typed arrays come out as the
+// muon package assembles them.
+func TestQueryChunkedArray(t *testing.T) {
+	var buf bytes.Buffer
+	e := muon.NewEncoder(&buf)
+	e.BeginArray(muon.Float32Array)
+	e.ArrayChunk([]float32{1, 2})
+	e.ArrayChunk([]float32{3})
+	e.EndArray()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// LEB128 integers, one chunk of which doesn't fit in an int64
+	big := []byte{0x85, 0xBB, 0x01, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x01, 0x05, 0x00}
+	for _, doc := range [][]byte{buf.Bytes(), big} {
+		vals, err := MustCompile(`$`).All(bytes.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want any
+		if err := muon.Unmarshal(doc, &want); err != nil {
+			t.Fatal(err)
+		}
+		if len(vals) != 1 || fmt.Sprintf("%T %v", vals[0], vals[0]) != fmt.Sprintf("%T %v", want, want) {
+			t.Errorf("got %T %v, want %T %v", vals[0], vals[0], want, want)
+		}
+	}
+}
+
+func TestQueryTruncated(t *testing.T) {
+	b := mustMarshal(t, store)
+	_, err := MustCompile(`$..name`).All(bytes.NewReader(b[:len(b)-10]))
+	if !errors.Is(err, muon.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestQuotedEscapes(t *testing.T) {
+	doc := muon.OrderedMap{
+		{Key: "😀", Value: 1},
+		{Key: "é\n", Value: 2},
+		{Key: "\ufffd", Value: 3},
+	}
+	b := mustMarshal(t, doc)
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{`$['\ud83d\ude00']`, "1"},
+		{`$["\u00e9\n"]`, "2"},
+		{`$['\ud83d']`, "3"},
+		{`$['\ud83d\u0041']`, ""},
+	} {
+		vals, err := MustCompile(tt.query).All(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := jsonResults(t, vals); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		offset int
+	}{
+		{``, 0},
+		{`items`, 0},
+		{`$.`, 2},
+		{`$[`, 2},
+		{`$[1`, 3},
+		{`$[-1]`, 2},
+		{`$['a`, 2},
+		{`$['\q']`, 5},
+		{`$[?(@.a < )]`, 10},
+		{`$[?(@.a < 1]`, 11},
+		{`$[?(@..a)]`, 4},
+		{`$[?(1)]`, 5},
+		{`$.a b`, 4},
+	} {
+		_, err := Compile(tt.query)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: got %v, want a SyntaxError", tt.query, err)
+			continue
+		}
+		if se.Offset != tt.offset {
+			t.Errorf("%s: got offset %d, want %d (%v)", tt.query, se.Offset, tt.offset, err)
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	items := make([]item, 10000)
+	for i := range items {
+		items[i] = item{Name: strings.Repeat("x", i%100), Price: float64(i), Qty: i, Tags: []string{"a", "b", "c"}}
+	}
+	doc := mustMarshal(b, map[string]any{"items": items}, muon.WithSizeTags())
+	for _, bm := range []string{`$.items[5000].name`, `$.items[*].price`, `$.items[?(@.qty < 10)].name`} {
+		q := MustCompile(bm)
+		b.Run(bm, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := q.All(bytes.NewReader(doc), muon.WithSizeTags()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}